@@ -4,4 +4,5 @@ set -exuo pipefail
 cd "$( dirname "${BASH_SOURCE[0]}" )/.."
 source .envrc
 
-GOOS=linux go build -o bin/compile compile
+GOOS=linux GOARCH=amd64 go build -o bin/multi-buildpack compile
+(cd bin && shasum -a 256 multi-buildpack > multi-buildpack.sha256)
@@ -0,0 +1,35 @@
+#!/bin/bash
+# Sourced by the bin scripts with $BUILDPACK_DIR set. Sets $multi_buildpack
+# to the prebuilt binary, or builds it from source if that is missing or does
+# not match its checksum. Logs to stderr, since detect and release own stdout.
+#
+# Only source checkouts (e.g. a buildpack given by its git URL) can build it:
+# packaged buildpacks include neither src/ nor scripts/install_go.sh. The
+# binary built is kept in $TMPDIR under the checksum of the source, so the
+# bin scripts run during one staging only build it once.
+
+multi_buildpack="$BUILDPACK_DIR/bin/multi-buildpack"
+
+if ! [ -f "$multi_buildpack" ] || ! (cd "$BUILDPACK_DIR/bin" && sha256sum --status -c multi-buildpack.sha256 2>/dev/null); then
+  if [ -f "$multi_buildpack" ]; then
+    echo "       **WARNING** $multi_buildpack does not match its checksum" >&2
+  fi
+  if [ ! -d "$BUILDPACK_DIR/src/compile" ] || [ ! -f "$BUILDPACK_DIR/scripts/install_go.sh" ]; then
+    echo "       **ERROR** No usable multi-buildpack binary, and no source to build one from" >&2
+    exit 1
+  fi
+
+  source_sum=$(cd "$BUILDPACK_DIR/src" && find compile -type f -name '*.go' -print0 | LC_ALL=C sort -z | xargs -0 sha256sum | sha256sum | cut -d ' ' -f 1)
+  multi_buildpack="${TMPDIR:-/tmp}/multi-buildpack-$source_sum/multi-buildpack"
+
+  if [ ! -x "$multi_buildpack" ]; then
+    source "$BUILDPACK_DIR/scripts/install_go.sh" >&2
+    output_dir=$(mktemp -d -t multi-buildpackXXX)
+
+    echo "-----> Running go build compile" >&2
+    GOROOT=$GoInstallDir/go GOPATH=$BUILDPACK_DIR $GoInstallDir/go/bin/go build -o $output_dir/multi-buildpack compile >&2
+    mkdir -p "$(dirname "$multi_buildpack")"
+    mv "$output_dir/multi-buildpack" "$multi_buildpack"
+    rmdir "$output_dir"
+  fi
+fi
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"code.cloudfoundry.org/buildpackapplifecycle"
+	"code.cloudfoundry.org/bytefmt"
+)
+
+// multiSupplyScriptName is the profile.d script in which the final buildpack
+// adds the bin, lib and other dirs of each deps dir to the launch environment
+const multiSupplyScriptName = "000_multi-supply.sh"
+
+// RemoveBuildOnlyDeps removes the deps dirs of the BuildOnly buildpacks from
+// depsDir once every buildpack has run, along with the profile.d scripts the
+// final buildpack installed for them into profileDir, named
+// <scriptPrefix><deps index>_<script>, and their entries in its
+// <scriptPrefix>000_multi-supply.sh. It logs the droplet size saved.
+func (c *MultiCompiler) RemoveBuildOnlyDeps(depsDir, profileDir, scriptPrefix string) error {
+	if len(c.BuildOnly) == 0 {
+		return nil
+	}
+
+	config := buildpackapplifecycle.NewLifecycleBuilderConfig(c.Buildpacks, true, false)
+
+	var saved uint64
+	removed := []string{}
+	for _, i := range c.BuildOnly {
+		depsIdx := config.DepsIndex(i)
+		depsIdxDir := filepath.Join(depsDir, depsIdx)
+		if _, err := os.Stat(depsIdxDir); os.IsNotExist(err) {
+			continue
+		}
+
+		scripts, err := ListProfileScripts(filepath.Join(depsIdxDir, "profile.d"))
+		if err != nil {
+			return err
+		}
+		for _, name := range scripts {
+			if err := os.RemoveAll(filepath.Join(profileDir, scriptPrefix+buildpackProfileScriptName(depsIdx, name))); err != nil {
+				return err
+			}
+		}
+
+		size, err := dirSize(depsIdxDir)
+		if err != nil {
+			return err
+		}
+		if err := os.RemoveAll(depsIdxDir); err != nil {
+			return err
+		}
+
+		c.Log.Info("Removed build-only buildpack %s from the droplet (%s)", c.Buildpacks[i], bytefmt.ByteSize(size))
+		saved += size
+		removed = append(removed, depsIdx)
+	}
+
+	if err := removeLaunchEnvDeps(filepath.Join(profileDir, scriptPrefix+multiSupplyScriptName), removed); err != nil {
+		return err
+	}
+
+	c.Log.BeginStep("Build-only buildpacks saved %s of droplet size", bytefmt.ByteSize(saved))
+	return nil
+}
+
+// removeLaunchEnvDeps drops the $DEPS_DIR/<idx>/... entries of the deps
+// indexes from the export lines of the multi-supply script at path, and the
+// lines left without entries
+func removeLaunchEnvDeps(path string, depsIdxs []string) error {
+	if len(depsIdxs) == 0 {
+		return nil
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	lines := []string{}
+	for _, line := range strings.Split(string(contents), "\n") {
+		// export PATH=$DEPS_DIR/1/bin:$DEPS_DIR/0/bin$([[ ! -z "${PATH:-}" ]] && echo ":$PATH")
+		start, end := strings.Index(line, "="), strings.Index(line, "$([[")
+		if strings.HasPrefix(line, "export ") && start >= 0 && end > start {
+			kept := []string{}
+			for _, entry := range strings.Split(line[start+1:end], ":") {
+				if !isDepsEntryOf(entry, depsIdxs) {
+					kept = append(kept, entry)
+				}
+			}
+			if len(kept) == 0 {
+				continue
+			}
+			line = line[:start+1] + strings.Join(kept, ":") + line[end:]
+		}
+		lines = append(lines, line)
+	}
+
+	return ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")), 0)
+}
+
+func isDepsEntryOf(entry string, depsIdxs []string) bool {
+	for _, depsIdx := range depsIdxs {
+		if strings.HasPrefix(entry, "$DEPS_DIR/"+depsIdx+"/") {
+			return true
+		}
+	}
+	return false
+}
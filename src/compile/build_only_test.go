@@ -0,0 +1,102 @@
+package main_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	c "compile"
+
+	"github.com/cloudfoundry/libbuildpack"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("RemoveBuildOnlyDeps", func() {
+	var (
+		err        error
+		buildDir   string
+		depsDir    string
+		profileDir string
+		compiler   *c.MultiCompiler
+		buffer     *bytes.Buffer
+	)
+
+	BeforeEach(func() {
+		buildDir, err = ioutil.TempDir("", "build")
+		Expect(err).To(BeNil())
+		depsDir = filepath.Join(buildDir, ".deps")
+		profileDir = filepath.Join(buildDir, ".profile.d")
+
+		buffer = new(bytes.Buffer)
+		compiler = &c.MultiCompiler{
+			BuildDir: buildDir,
+			Log:      libbuildpack.NewLogger(buffer),
+			Buildpacks: []string{
+				"https://github.com/cloudfoundry/nodejs-buildpack",
+				"https://github.com/cloudfoundry/python-buildpack",
+				"https://github.com/cloudfoundry/ruby-buildpack",
+			},
+			BuildOnly: []int{0},
+		}
+
+		writeFile(filepath.Join(depsDir, "0", "node", "bin", "node"), "1234567890")
+		writeFile(filepath.Join(depsDir, "0", "env", "NODE_HOME"), "/tmp/deps/0/node")
+		writeFile(filepath.Join(depsDir, "0", "profile.d", "node.sh"), "export NODE_HOME=$DEPS_DIR/0/node")
+		writeFile(filepath.Join(depsDir, "1", "python", "bin", "python"), "python")
+		writeFile(filepath.Join(depsDir, "1", "profile.d", "python.sh"), "export PYTHONHOME=$DEPS_DIR/1/python")
+		writeFile(filepath.Join(profileDir, "00000001_2_0_node.sh"), "export NODE_HOME=$DEPS_DIR/0/node")
+		writeFile(filepath.Join(profileDir, "00000001_2_1_python.sh"), "export PYTHONHOME=$DEPS_DIR/1/python")
+		writeFile(filepath.Join(profileDir, "node.sh"), "export NODE_ENV=production")
+		writeFile(filepath.Join(profileDir, "00000001_2_000_multi-supply.sh"), `export PATH=$DEPS_DIR/1/bin:$DEPS_DIR/0/bin$([[ ! -z "${PATH:-}" ]] && echo ":$PATH")
+export LD_LIBRARY_PATH=$DEPS_DIR/0/lib$([[ ! -z "${LD_LIBRARY_PATH:-}" ]] && echo ":$LD_LIBRARY_PATH")
+`)
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(buildDir)).To(Succeed())
+	})
+
+	It("removes the deps dirs of the build-only buildpacks", func() {
+		Expect(compiler.RemoveBuildOnlyDeps(depsDir, profileDir, "00000001_2_")).To(Succeed())
+
+		Expect(filepath.Join(depsDir, "0")).NotTo(BeADirectory())
+		Expect(filepath.Join(depsDir, "1", "python", "bin", "python")).To(BeAnExistingFile())
+	})
+
+	It("removes the profile.d scripts installed for them", func() {
+		Expect(compiler.RemoveBuildOnlyDeps(depsDir, profileDir, "00000001_2_")).To(Succeed())
+
+		Expect(filepath.Join(profileDir, "00000001_2_0_node.sh")).NotTo(BeAnExistingFile())
+		Expect(filepath.Join(profileDir, "00000001_2_1_python.sh")).To(BeAnExistingFile())
+		Expect(filepath.Join(profileDir, "node.sh")).To(BeAnExistingFile())
+	})
+
+	It("removes their entries from the launch environment", func() {
+		Expect(compiler.RemoveBuildOnlyDeps(depsDir, profileDir, "00000001_2_")).To(Succeed())
+
+		Expect(ioutil.ReadFile(filepath.Join(profileDir, "00000001_2_000_multi-supply.sh"))).To(Equal([]byte(`export PATH=$DEPS_DIR/1/bin$([[ ! -z "${PATH:-}" ]] && echo ":$PATH")
+`)))
+	})
+
+	It("reports the droplet size saved", func() {
+		Expect(compiler.RemoveBuildOnlyDeps(depsDir, profileDir, "00000001_2_")).To(Succeed())
+
+		Expect(buffer.String()).To(ContainSubstring("Removed build-only buildpack https://github.com/cloudfoundry/nodejs-buildpack from the droplet (59B)"))
+		Expect(buffer.String()).To(ContainSubstring("Build-only buildpacks saved 59B of droplet size"))
+	})
+
+	Context("there are no build-only buildpacks", func() {
+		BeforeEach(func() {
+			compiler.BuildOnly = nil
+		})
+
+		It("leaves the deps alone", func() {
+			Expect(compiler.RemoveBuildOnlyDeps(depsDir, profileDir, "00000001_2_")).To(Succeed())
+
+			Expect(filepath.Join(depsDir, "0", "node", "bin", "node")).To(BeAnExistingFile())
+			Expect(buffer.String()).To(Equal(""))
+		})
+	})
+})
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"code.cloudfoundry.org/bytefmt"
+	"github.com/cloudfoundry/libbuildpack"
+)
+
+// legacyFinalCacheDir is where buildpackrunner kept the final buildpack's cache
+const legacyFinalCacheDir = "final"
+
+// cacheKeysFile records the cache key of each buildpack URL, so a skipped
+// buildpack, whose manifest.yml is unavailable, keeps its cache. Cache keys
+// never start with a dot, so it cannot clash with a cache dir.
+const cacheKeysFile = ".buildpack_keys.yml"
+
+var invalidCacheKeyChars = regexp.MustCompile(`[^a-z0-9_.-]+`)
+
+// BuildpackCache manages the per-buildpack dirs in the build artifacts cache.
+// Dirs are keyed by the name a buildpack gives itself in its manifest.yml, so
+// bumping the version in a buildpack URL keeps its cache.
+type BuildpackCache struct {
+	Dir   string
+	Limit uint64
+	Clear []string
+	Log   *libbuildpack.Logger
+
+	keys  []string
+	paths map[string]string
+}
+
+// NewBuildpackCache creates a new BuildpackCache. A limit of 0 disables the
+// per-buildpack size cap.
+func NewBuildpackCache(dir string, limit uint64, clear []string, logger *libbuildpack.Logger) *BuildpackCache {
+	return &BuildpackCache{
+		Dir:   dir,
+		Limit: limit,
+		Clear: clear,
+		Log:   logger,
+		paths: map[string]string{},
+	}
+}
+
+// ParseClearCache splits a comma separated list of caches to clear
+func ParseClearCache(value string) []string {
+	targets := []string{}
+	for _, target := range strings.Split(value, ",") {
+		if target = strings.TrimSpace(target); target != "" {
+			targets = append(targets, target)
+		}
+	}
+	return targets
+}
+
+// Setup assigns a cache dir to each buildpack, migrating dirs kept under an
+// older key, removes the dirs no buildpack uses anymore and clears the caches
+// the user asked to clear. Skipped buildpacks have an empty path and keep the
+// key they had in the last staging.
+func (bc *BuildpackCache) Setup(buildpacks []string, buildpackPaths []string) error {
+	if err := os.MkdirAll(bc.Dir, 0755); err != nil {
+		return err
+	}
+
+	lastKeys := map[string]string{}
+	if err := libbuildpack.NewYAML().Load(filepath.Join(bc.Dir, cacheKeysFile), &lastKeys); err != nil && !os.IsNotExist(err) {
+		bc.Log.Warning("Unable to read the build cache keys: %s", err.Error())
+	}
+
+	bc.keys = []string{}
+	keys := map[string]string{}
+	claimed := map[string]bool{cacheKeysFile: true}
+
+	for i, buildpack := range buildpacks {
+		var key string
+		if buildpackPaths[i] != "" {
+			key = BuildpackCacheKey(buildpack, buildpackPaths[i])
+		} else if lastKeys[buildpack] != "" {
+			key = lastKeys[buildpack]
+		} else {
+			key = legacyCacheKey(buildpack)
+		}
+		if claimed[key] {
+			key = legacyCacheKey(buildpack)
+		}
+		claimed[key] = true
+		keys[buildpack] = key
+
+		bc.keys = append(bc.keys, key)
+		bc.paths[buildpack] = filepath.Join(bc.Dir, key)
+	}
+
+	for i, buildpack := range buildpacks {
+		if err := bc.migrate(buildpack, bc.keys[i], i == len(buildpacks)-1, claimed); err != nil {
+			return err
+		}
+	}
+
+	if err := libbuildpack.NewYAML().Write(filepath.Join(bc.Dir, cacheKeysFile), keys); err != nil {
+		return err
+	}
+
+	dirs, err := ioutil.ReadDir(bc.Dir)
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range dirs {
+		if !claimed[dir.Name()] {
+			if err := os.RemoveAll(filepath.Join(bc.Dir, dir.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	return bc.clear(buildpacks)
+}
+
+// clear empties the caches selected by Clear, which holds "all", buildpack
+// names or indexes into the buildpack list
+func (bc *BuildpackCache) clear(buildpacks []string) error {
+	if len(bc.Clear) == 0 {
+		return nil
+	}
+
+	cleared := map[string]bool{}
+	var freed uint64
+
+	bc.Log.BeginStep("Clearing build caches")
+	for _, target := range bc.Clear {
+		keys := bc.matchingKeys(target, buildpacks)
+		if len(keys) == 0 {
+			bc.Log.Warning("No buildpack build cache matches %s", target)
+			continue
+		}
+
+		for _, key := range keys {
+			if cleared[key] {
+				continue
+			}
+			cleared[key] = true
+
+			path := filepath.Join(bc.Dir, key)
+			size, err := dirSize(path)
+			if err != nil {
+				return err
+			}
+			if err := os.RemoveAll(path); err != nil {
+				return err
+			}
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return err
+			}
+
+			bc.Log.Info("Removed %s (%s)", path, bytefmt.ByteSize(size))
+			freed += size
+		}
+	}
+	bc.Log.Info("Freed %s", bytefmt.ByteSize(freed))
+
+	return nil
+}
+
+func (bc *BuildpackCache) matchingKeys(target string, buildpacks []string) []string {
+	if target == "all" {
+		return bc.keys
+	}
+
+	if idx, err := strconv.Atoi(target); err == nil {
+		if idx >= 0 && idx < len(bc.keys) {
+			return []string{bc.keys[idx]}
+		}
+		return nil
+	}
+
+	for i, key := range bc.keys {
+		if key == cacheKeyFromName(target) || buildpacks[i] == target {
+			return []string{key}
+		}
+	}
+	return nil
+}
+
+func (bc *BuildpackCache) migrate(buildpack, key string, final bool, claimed map[string]bool) error {
+	path := filepath.Join(bc.Dir, key)
+
+	if exists, err := libbuildpack.FileExists(path); err != nil {
+		return err
+	} else if exists {
+		return nil
+	}
+
+	candidates := []string{legacyCacheKey(buildpack)}
+	if final {
+		candidates = append(candidates, legacyFinalCacheDir)
+	}
+
+	// the buildpack URL changed before the cache was keyed by name; find the
+	// old dir from the metadata libbuildpack stores in it
+	dirs, err := ioutil.ReadDir(bc.Dir)
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		md := libbuildpack.BuildpackMetadata{}
+		if err := libbuildpack.NewYAML().Load(filepath.Join(bc.Dir, dir.Name(), "BUILDPACK_METADATA"), &md); err == nil && cacheKeyFromName(md.Language) == key {
+			candidates = append(candidates, dir.Name())
+		}
+	}
+
+	for _, candidate := range candidates {
+		if candidate == key || claimed[candidate] {
+			continue
+		}
+
+		oldPath := filepath.Join(bc.Dir, candidate)
+		if exists, err := libbuildpack.FileExists(oldPath); err != nil {
+			return err
+		} else if exists {
+			bc.Log.Info("Migrating build cache for %s from %s to %s", buildpack, candidate, key)
+			return os.Rename(oldPath, path)
+		}
+	}
+
+	return os.MkdirAll(path, 0755)
+}
+
+// Key returns the cache key of the buildpack at index i of the list given to
+// Setup
+func (bc *BuildpackCache) Key(i int) string {
+	if i < 0 || i >= len(bc.keys) {
+		return ""
+	}
+	return bc.keys[i]
+}
+
+// Path returns the cache dir for a buildpack
+func (bc *BuildpackCache) Path(buildpack string) string {
+	if path, found := bc.paths[buildpack]; found {
+		return path
+	}
+	return filepath.Join(bc.Dir, legacyCacheKey(buildpack))
+}
+
+// Finish clears the caches that grew past the size cap and prints the size of
+// each buildpack's cache
+func (bc *BuildpackCache) Finish() error {
+	if len(bc.keys) == 0 {
+		return nil
+	}
+
+	summary := []string{}
+	for _, key := range bc.keys {
+		path := filepath.Join(bc.Dir, key)
+
+		size, err := dirSize(path)
+		if err != nil {
+			return err
+		}
+
+		if bc.Limit > 0 && size > bc.Limit {
+			bc.Log.Warning("The build cache for %s is %s, over the %s limit; clearing it", key, bytefmt.ByteSize(size), bytefmt.ByteSize(bc.Limit))
+			if err := os.RemoveAll(path); err != nil {
+				return err
+			}
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return err
+			}
+			size = 0
+		}
+
+		summary = append(summary, fmt.Sprintf("%s: %s", key, bytefmt.ByteSize(size)))
+	}
+
+	bc.Log.BeginStep("Build cache sizes:")
+	bc.Log.Info("%s", strings.Join(summary, "\n"))
+	return nil
+}
+
+// BuildpackCacheKey returns the name of the cache dir for a buildpack, taken
+// from the language in its manifest.yml. Buildpacks without one fall back to
+// an md5 of their URL.
+func BuildpackCacheKey(buildpack, buildpackPath string) string {
+	manifest := struct {
+		Language string `yaml:"language"`
+	}{}
+
+	if err := libbuildpack.NewYAML().Load(filepath.Join(buildpackPath, "manifest.yml"), &manifest); err == nil {
+		if key := cacheKeyFromName(manifest.Language); key != "" {
+			return key
+		}
+	}
+
+	return legacyCacheKey(buildpack)
+}
+
+func cacheKeyFromName(name string) string {
+	return strings.Trim(invalidCacheKeyChars.ReplaceAllString(strings.ToLower(name), "_"), "_.")
+}
+
+func legacyCacheKey(buildpack string) string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(buildpack)))
+}
+
+func dirSize(dir string) (uint64, error) {
+	var size uint64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += uint64(info.Size())
+		}
+		return nil
+	})
+	return size, err
+}
@@ -0,0 +1,256 @@
+package main_test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	c "compile"
+
+	"github.com/cloudfoundry/libbuildpack"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("BuildpackCache", func() {
+	var (
+		err            error
+		cacheDir       string
+		buildpacksDir  string
+		buildpacks     []string
+		buildpackPaths []string
+		cache          *c.BuildpackCache
+		buffer         *bytes.Buffer
+	)
+
+	legacyKey := func(buildpack string) string {
+		return fmt.Sprintf("%x", md5.Sum([]byte(buildpack)))
+	}
+
+	newBuildpack := func(name, language string) string {
+		path := filepath.Join(buildpacksDir, name)
+		writeBuildpack(path, language, nil)
+		return path
+	}
+
+	BeforeEach(func() {
+		cacheDir, err = ioutil.TempDir("", "cache")
+		Expect(err).To(BeNil())
+
+		buildpacksDir, err = ioutil.TempDir("", "buildpacks")
+		Expect(err).To(BeNil())
+
+		buffer = new(bytes.Buffer)
+		cache = c.NewBuildpackCache(cacheDir, 0, []string{}, libbuildpack.NewLogger(buffer))
+
+		buildpacks = []string{
+			"https://github.com/cloudfoundry/ruby-buildpack#v1.7.2",
+			"https://github.com/cloudfoundry/go-buildpack#v1.8.0",
+		}
+		buildpackPaths = []string{
+			newBuildpack("ruby", "ruby"),
+			newBuildpack("go", "go"),
+		}
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(cacheDir)).To(Succeed())
+		Expect(os.RemoveAll(buildpacksDir)).To(Succeed())
+	})
+
+	Describe("Setup", func() {
+		It("keys the cache dirs by the buildpack's language", func() {
+			Expect(cache.Setup(buildpacks, buildpackPaths)).To(Succeed())
+
+			Expect(cache.Path(buildpacks[0])).To(Equal(filepath.Join(cacheDir, "ruby")))
+			Expect(cache.Path(buildpacks[1])).To(Equal(filepath.Join(cacheDir, "go")))
+			Expect(filepath.Join(cacheDir, "ruby")).To(BeADirectory())
+		})
+
+		It("keys buildpacks without a manifest by the md5 of their url", func() {
+			buildpackPaths[1] = newBuildpack("custom", "")
+			Expect(cache.Setup(buildpacks, buildpackPaths)).To(Succeed())
+
+			Expect(cache.Path(buildpacks[1])).To(Equal(filepath.Join(cacheDir, legacyKey(buildpacks[1]))))
+		})
+
+		It("keeps the cache when the buildpack version changes", func() {
+			Expect(cache.Setup(buildpacks, buildpackPaths)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(cacheDir, "ruby", "gems"), []byte("gems"), 0644)).To(Succeed())
+
+			buildpacks[0] = "https://github.com/cloudfoundry/ruby-buildpack#v1.7.3"
+			Expect(cache.Setup(buildpacks, buildpackPaths)).To(Succeed())
+
+			Expect(ioutil.ReadFile(filepath.Join(cacheDir, "ruby", "gems"))).To(Equal([]byte("gems")))
+		})
+
+		It("removes cache dirs no buildpack uses", func() {
+			Expect(os.MkdirAll(filepath.Join(cacheDir, "nodejs"), 0755)).To(Succeed())
+			Expect(cache.Setup(buildpacks, buildpackPaths)).To(Succeed())
+
+			Expect(filepath.Join(cacheDir, "nodejs")).NotTo(BeADirectory())
+		})
+
+		Context("a buildpack is skipped", func() {
+			BeforeEach(func() {
+				Expect(cache.Setup(buildpacks, buildpackPaths)).To(Succeed())
+				Expect(ioutil.WriteFile(filepath.Join(cacheDir, "ruby", "gems"), []byte("gems"), 0644)).To(Succeed())
+				buildpackPaths[0] = ""
+			})
+
+			It("keeps its cache under the key of the last staging", func() {
+				Expect(cache.Setup(buildpacks, buildpackPaths)).To(Succeed())
+
+				Expect(cache.Path(buildpacks[0])).To(Equal(filepath.Join(cacheDir, "ruby")))
+				Expect(ioutil.ReadFile(filepath.Join(cacheDir, "ruby", "gems"))).To(Equal([]byte("gems")))
+			})
+
+			It("does not read a manifest.yml from the working directory", func() {
+				wd, err := os.Getwd()
+				Expect(err).To(BeNil())
+				defer os.Chdir(wd)
+				Expect(os.Chdir(newBuildpack("cwd", "go"))).To(Succeed())
+
+				Expect(cache.Setup(buildpacks, buildpackPaths)).To(Succeed())
+
+				Expect(cache.Path(buildpacks[0])).To(Equal(filepath.Join(cacheDir, "ruby")))
+				Expect(cache.Path(buildpacks[1])).To(Equal(filepath.Join(cacheDir, "go")))
+			})
+		})
+
+		Context("caches kept under the old keys", func() {
+			It("migrates the md5 keyed dir of the same url", func() {
+				Expect(os.MkdirAll(filepath.Join(cacheDir, legacyKey(buildpacks[0])), 0755)).To(Succeed())
+				Expect(ioutil.WriteFile(filepath.Join(cacheDir, legacyKey(buildpacks[0]), "gems"), []byte("gems"), 0644)).To(Succeed())
+
+				Expect(cache.Setup(buildpacks, buildpackPaths)).To(Succeed())
+
+				Expect(ioutil.ReadFile(filepath.Join(cacheDir, "ruby", "gems"))).To(Equal([]byte("gems")))
+				Expect(buffer.String()).To(ContainSubstring("Migrating build cache for " + buildpacks[0]))
+			})
+
+			It("migrates a dir whose BUILDPACK_METADATA names the buildpack", func() {
+				oldKey := legacyKey("https://github.com/cloudfoundry/ruby-buildpack#v1.7.1")
+				Expect(os.MkdirAll(filepath.Join(cacheDir, oldKey), 0755)).To(Succeed())
+				Expect(ioutil.WriteFile(filepath.Join(cacheDir, oldKey, "BUILDPACK_METADATA"), []byte("language: ruby\nversion: 1.7.1\n"), 0644)).To(Succeed())
+
+				Expect(cache.Setup(buildpacks, buildpackPaths)).To(Succeed())
+
+				Expect(filepath.Join(cacheDir, "ruby", "BUILDPACK_METADATA")).To(BeAnExistingFile())
+				Expect(filepath.Join(cacheDir, oldKey)).NotTo(BeADirectory())
+			})
+
+			It("migrates the final dir to the final buildpack", func() {
+				Expect(os.MkdirAll(filepath.Join(cacheDir, "final"), 0755)).To(Succeed())
+				Expect(ioutil.WriteFile(filepath.Join(cacheDir, "final", "pkg"), []byte("pkg"), 0644)).To(Succeed())
+
+				Expect(cache.Setup(buildpacks, buildpackPaths)).To(Succeed())
+
+				Expect(ioutil.ReadFile(filepath.Join(cacheDir, "go", "pkg"))).To(Equal([]byte("pkg")))
+			})
+		})
+	})
+
+	Describe("clearing caches", func() {
+		BeforeEach(func() {
+			Expect(cache.Setup(buildpacks, buildpackPaths)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(cacheDir, "ruby", "gems"), bytes.Repeat([]byte("x"), 2048), 0644)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(cacheDir, "go", "pkg"), []byte("pkg"), 0644)).To(Succeed())
+			buffer.Reset()
+		})
+
+		It("does nothing by default", func() {
+			Expect(cache.Setup(buildpacks, buildpackPaths)).To(Succeed())
+
+			Expect(filepath.Join(cacheDir, "ruby", "gems")).To(BeAnExistingFile())
+			Expect(buffer.String()).NotTo(ContainSubstring("Clearing build caches"))
+		})
+
+		It("clears a cache by name", func() {
+			cache.Clear = []string{"ruby"}
+			Expect(cache.Setup(buildpacks, buildpackPaths)).To(Succeed())
+
+			Expect(filepath.Join(cacheDir, "ruby")).To(BeADirectory())
+			Expect(filepath.Join(cacheDir, "ruby", "gems")).NotTo(BeAnExistingFile())
+			Expect(filepath.Join(cacheDir, "go", "pkg")).To(BeAnExistingFile())
+		})
+
+		It("clears a cache by index", func() {
+			cache.Clear = []string{"1"}
+			Expect(cache.Setup(buildpacks, buildpackPaths)).To(Succeed())
+
+			Expect(filepath.Join(cacheDir, "ruby", "gems")).To(BeAnExistingFile())
+			Expect(filepath.Join(cacheDir, "go", "pkg")).NotTo(BeAnExistingFile())
+		})
+
+		It("clears every cache", func() {
+			cache.Clear = []string{"all"}
+			Expect(cache.Setup(buildpacks, buildpackPaths)).To(Succeed())
+
+			Expect(filepath.Join(cacheDir, "ruby", "gems")).NotTo(BeAnExistingFile())
+			Expect(filepath.Join(cacheDir, "go", "pkg")).NotTo(BeAnExistingFile())
+		})
+
+		It("logs the removed dirs and the space freed", func() {
+			cache.Clear = []string{"all", "ruby"}
+			Expect(cache.Setup(buildpacks, buildpackPaths)).To(Succeed())
+
+			Expect(buffer.String()).To(ContainSubstring("Removed " + filepath.Join(cacheDir, "ruby") + " (2K)"))
+			Expect(buffer.String()).To(ContainSubstring("Removed " + filepath.Join(cacheDir, "go") + " (3B)"))
+			Expect(buffer.String()).To(ContainSubstring("Freed 2K"))
+		})
+
+		It("warns about caches that do not exist", func() {
+			cache.Clear = []string{"php", "5"}
+			Expect(cache.Setup(buildpacks, buildpackPaths)).To(Succeed())
+
+			Expect(buffer.String()).To(ContainSubstring("No buildpack build cache matches php"))
+			Expect(buffer.String()).To(ContainSubstring("No buildpack build cache matches 5"))
+		})
+	})
+
+	Describe("ParseClearCache", func() {
+		It("splits a comma separated list", func() {
+			Expect(c.ParseClearCache("ruby, 0,,all")).To(Equal([]string{"ruby", "0", "all"}))
+			Expect(c.ParseClearCache("")).To(BeEmpty())
+		})
+	})
+
+	Describe("Finish", func() {
+		BeforeEach(func() {
+			Expect(cache.Setup(buildpacks, buildpackPaths)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(cacheDir, "ruby", "gems"), bytes.Repeat([]byte("x"), 2048), 0644)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(cacheDir, "go", "pkg"), []byte("pkg"), 0644)).To(Succeed())
+		})
+
+		It("prints the size of each cache", func() {
+			Expect(cache.Finish()).To(Succeed())
+
+			Expect(buffer.String()).To(ContainSubstring("Build cache sizes:"))
+			Expect(buffer.String()).To(ContainSubstring("ruby: 2K"))
+			Expect(buffer.String()).To(ContainSubstring("go: 3B"))
+		})
+
+		Context("a cache is over the limit", func() {
+			BeforeEach(func() {
+				cache.Limit = 1024
+			})
+
+			It("clears that cache", func() {
+				Expect(cache.Finish()).To(Succeed())
+
+				Expect(filepath.Join(cacheDir, "ruby")).To(BeADirectory())
+				Expect(filepath.Join(cacheDir, "ruby", "gems")).NotTo(BeAnExistingFile())
+				Expect(filepath.Join(cacheDir, "go", "pkg")).To(BeAnExistingFile())
+			})
+
+			It("warns the user", func() {
+				Expect(cache.Finish()).To(Succeed())
+				Expect(buffer.String()).To(ContainSubstring("The build cache for ruby is 2K, over the 1K limit; clearing it"))
+			})
+		})
+	})
+})
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// CNBLayersDir is the sub dir of a Cloud Native Buildpack's deps dir that is
+// given to its bin/build as the layers dir
+const CNBLayersDir = "layers"
+
+// CNBProfileScriptName sets the launch environment of a Cloud Native
+// Buildpack's layers
+const CNBProfileScriptName = "cnb_env.sh"
+
+// cnbDescriptor is the part of a buildpack.toml the multi-buildpack uses
+type cnbDescriptor struct {
+	API       string `toml:"api"`
+	Buildpack struct {
+		ID      string `toml:"id"`
+		Version string `toml:"version"`
+	} `toml:"buildpack"`
+}
+
+// cnbLayerMetadata is a <layer>.toml; from buildpack API 0.6 on, the flags
+// are in its types table
+type cnbLayerMetadata struct {
+	Build  bool `toml:"build"`
+	Launch bool `toml:"launch"`
+	Types  struct {
+		Build  bool `toml:"build"`
+		Launch bool `toml:"launch"`
+	} `toml:"types"`
+}
+
+// IsCNB reports whether the buildpack at buildpackPath is a Cloud Native
+// Buildpack: one with a buildpack.toml and bin/build but no bin/supply
+func IsCNB(buildpackPath string) bool {
+	for _, file := range []string{"buildpack.toml", filepath.Join("bin", "build")} {
+		if _, err := os.Stat(filepath.Join(buildpackPath, file)); err != nil {
+			return false
+		}
+	}
+	_, err := os.Stat(filepath.Join(buildpackPath, "bin", "supply"))
+	return os.IsNotExist(err)
+}
+
+// runCNBBuild runs the build phase of the Cloud Native Buildpack at
+// buildpackPath with a layers dir inside its deps dir, then translates the
+// layers into the deps dir conventions of v2 buildpacks
+func (r *BuildpackRunner) runCNBBuild(buildpackPath, depsIdx string) error {
+	descriptor := cnbDescriptor{}
+	if _, err := toml.DecodeFile(filepath.Join(buildpackPath, "buildpack.toml"), &descriptor); err != nil {
+		return fmt.Errorf("Unable to read buildpack.toml: %s", err.Error())
+	}
+
+	depsIdxDir := filepath.Join(r.depsDir, depsIdx)
+	if err := os.MkdirAll(filepath.Join(depsIdxDir, CNBLayersDir), 0755); err != nil {
+		return err
+	}
+
+	// the buildpack is not detected, so there is no platform env or build plan
+	platformDir, err := ioutil.TempDir("", "platform")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(platformDir)
+	if err := os.MkdirAll(filepath.Join(platformDir, "env"), 0755); err != nil {
+		return err
+	}
+	planFile := filepath.Join(platformDir, "plan.toml")
+	if err := ioutil.WriteFile(planFile, []byte{}, 0644); err != nil {
+		return err
+	}
+
+	cmd := exec.Command(filepath.Join(buildpackPath, "bin", "build"), filepath.Join(depsIdxDir, CNBLayersDir), platformDir, planFile)
+	cmd.Dir = r.config.BuildDir()
+	cmd.Env = os.Environ()
+	if stack := os.Getenv("CF_STACK"); stack != "" {
+		cmd.Env = append(cmd.Env, "CNB_STACK_ID=org.cloudfoundry.stacks."+stack)
+	}
+	if err := r.run(cmd); err != nil {
+		return err
+	}
+
+	if err := TranslateCNBLayers(depsIdxDir, depsIdx, descriptor.API); err != nil {
+		return fmt.Errorf("Unable to translate the layers of %s: %s", descriptor.Buildpack.ID, err.Error())
+	}
+
+	configYml := fmt.Sprintf("name: %s\n", descriptor.Buildpack.ID)
+	if version := descriptor.Buildpack.Version; version != "" {
+		configYml += fmt.Sprintf("version: %s\n", version)
+	}
+	return ioutil.WriteFile(filepath.Join(depsIdxDir, "config.yml"), []byte(configYml), 0644)
+}
+
+// TranslateCNBLayers exposes the layers a Cloud Native Buildpack built in
+// depsIdxDir/layers the way a v2 supply buildpack would: their bin, lib,
+// include and pkgconfig files are linked into depsIdxDir, their build env is
+// written to depsIdxDir/env and their launch env to a profile.d script.
+// Layers used for neither build nor launch are removed.
+func TranslateCNBLayers(depsIdxDir, depsIdx, api string) error {
+	layersDir := filepath.Join(depsIdxDir, CNBLayersDir)
+	files, err := readDirIfExists(layersDir)
+	if err != nil {
+		return err
+	}
+
+	buildEnv := newCNBEnv(api)
+	launchEnv := newCNBEnv(api)
+
+	// layers are applied in name order, later ones overriding earlier ones
+	for _, file := range files {
+		if !file.IsDir() {
+			continue
+		}
+		layer := file.Name()
+		layerDir := filepath.Join(layersDir, layer)
+
+		metadata := cnbLayerMetadata{}
+		if _, err := toml.DecodeFile(layerDir+".toml", &metadata); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		build := metadata.Build || metadata.Types.Build
+		launch := metadata.Launch || metadata.Types.Launch
+
+		if !build && !launch {
+			if err := os.RemoveAll(layerDir); err != nil {
+				return err
+			}
+			continue
+		}
+
+		for _, dir := range nestedDepsLinkDirs {
+			files, err := readDirIfExists(filepath.Join(layerDir, dir))
+			if err != nil {
+				return err
+			}
+			for _, file := range files {
+				if err := os.MkdirAll(filepath.Join(depsIdxDir, dir), 0755); err != nil {
+					return err
+				}
+				dest := filepath.Join(depsIdxDir, dir, file.Name())
+				if err := os.RemoveAll(dest); err != nil {
+					return err
+				}
+				if err := os.Symlink(filepath.Join("..", CNBLayersDir, layer, dir, file.Name()), dest); err != nil {
+					return err
+				}
+			}
+		}
+
+		if build {
+			if err := buildEnv.read(filepath.Join(layerDir, "env"), filepath.Join(layerDir, "env.build")); err != nil {
+				return err
+			}
+		}
+		if launch {
+			if err := launchEnv.read(filepath.Join(layerDir, "env"), filepath.Join(layerDir, "env.launch")); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(buildEnv.names) > 0 {
+		if err := os.MkdirAll(filepath.Join(depsIdxDir, "env"), 0755); err != nil {
+			return err
+		}
+		for _, name := range buildEnv.names {
+			if err := ioutil.WriteFile(filepath.Join(depsIdxDir, "env", name), []byte(buildEnv.value(name)), 0644); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(launchEnv.names) > 0 {
+		if err := os.MkdirAll(filepath.Join(depsIdxDir, "profile.d"), 0755); err != nil {
+			return err
+		}
+		script := strings.Replace(launchEnv.script(), shellEscape(layersDir), "$DEPS_DIR/"+depsIdx+"/"+CNBLayersDir, -1)
+		if err := ioutil.WriteFile(filepath.Join(depsIdxDir, "profile.d", CNBProfileScriptName), []byte(script), 0644); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type cnbEnvChange struct {
+	action string
+	value  string
+	delim  string
+}
+
+// cnbEnv collects the changes a buildpack's layer env dirs make to each
+// environment variable, in order
+type cnbEnv struct {
+	names   []string
+	changes map[string][]cnbEnvChange
+	// files without a suffix override the variable from buildpack API 0.5,
+	// and prepend to it with the path list separator before that
+	plainAction string
+}
+
+func newCNBEnv(api string) *cnbEnv {
+	env := &cnbEnv{changes: map[string][]cnbEnvChange{}, plainAction: "prepend"}
+	if parts := strings.SplitN(api, ".", 3); len(parts) >= 2 {
+		major, _ := strconv.Atoi(parts[0])
+		minor, _ := strconv.Atoi(parts[1])
+		if major > 0 || minor >= 5 {
+			env.plainAction = "override"
+		}
+	}
+	return env
+}
+
+func (e *cnbEnv) read(dirs ...string) error {
+	for _, dir := range dirs {
+		files, err := readDirIfExists(dir)
+		if err != nil {
+			return err
+		}
+
+		delims := map[string]string{}
+		for _, file := range files {
+			if strings.HasSuffix(file.Name(), ".delim") {
+				data, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+				if err != nil {
+					return err
+				}
+				delims[strings.TrimSuffix(file.Name(), ".delim")] = string(data)
+			}
+		}
+
+		for _, file := range files {
+			if !file.Mode().IsRegular() {
+				continue
+			}
+
+			name, action := file.Name(), e.plainAction
+			delim := string(os.PathListSeparator)
+			if ext := filepath.Ext(name); ext != "" {
+				name, action = strings.TrimSuffix(name, ext), ext[1:]
+				delim = delims[name]
+			}
+
+			switch action {
+			case "delim":
+				continue
+			case "override", "default", "prepend", "append":
+			default:
+				return fmt.Errorf("unsupported env file %s", filepath.Join(dir, file.Name()))
+			}
+
+			data, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+			if err != nil {
+				return err
+			}
+
+			if _, found := e.changes[name]; !found {
+				e.names = append(e.names, name)
+			}
+			e.changes[name] = append(e.changes[name], cnbEnvChange{action: action, value: string(data), delim: delim})
+		}
+	}
+
+	sort.Strings(e.names)
+	return nil
+}
+
+// value applies the changes to name to its value in the current environment
+func (e *cnbEnv) value(name string) string {
+	value, set := os.LookupEnv(name)
+	for _, change := range e.changes[name] {
+		switch change.action {
+		case "override":
+			value = change.value
+		case "default":
+			if !set {
+				value = change.value
+			}
+		case "prepend":
+			if value != "" {
+				value = change.value + change.delim + value
+			} else {
+				value = change.value
+			}
+		case "append":
+			if value != "" {
+				value = value + change.delim + change.value
+			} else {
+				value = change.value
+			}
+		}
+		set = true
+	}
+	return value
+}
+
+// script returns the shell commands making the changes at launch
+func (e *cnbEnv) script() string {
+	script := new(bytes.Buffer)
+	for _, name := range e.names {
+		for _, change := range e.changes[name] {
+			value, delim := shellEscape(change.value), shellEscape(change.delim)
+			switch change.action {
+			case "override":
+				fmt.Fprintf(script, "export %s=\"%s\"\n", name, value)
+			case "default":
+				fmt.Fprintf(script, "[ -n \"${%s+x}\" ] || export %s=\"%s\"\n", name, name, value)
+			case "prepend":
+				fmt.Fprintf(script, "export %s=\"%s${%s:+%s}${%s}\"\n", name, value, name, delim, name)
+			case "append":
+				fmt.Fprintf(script, "export %s=\"${%s}${%s:+%s}%s\"\n", name, name, name, delim, value)
+			}
+		}
+	}
+	return script.String()
+}
+
+// shellEscape escapes s for use inside double quotes
+func shellEscape(s string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`")
+	return replacer.Replace(s)
+}
@@ -0,0 +1,101 @@
+package main_test
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	c "compile"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Cloud Native Buildpacks", func() {
+	var (
+		err    error
+		tmpDir string
+	)
+
+	BeforeEach(func() {
+		tmpDir, err = ioutil.TempDir("", "cnb")
+		Expect(err).To(BeNil())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(tmpDir)).To(Succeed())
+	})
+
+	Describe("IsCNB", func() {
+		It("is true for a buildpack with buildpack.toml and bin/build", func() {
+			writeFile(filepath.Join(tmpDir, "buildpack.toml"), "[buildpack]\nid = \"org.example.node\"\n")
+			writeFile(filepath.Join(tmpDir, "bin", "build"), "")
+			Expect(c.IsCNB(tmpDir)).To(BeTrue())
+		})
+
+		It("is false for a buildpack that can also supply", func() {
+			writeFile(filepath.Join(tmpDir, "buildpack.toml"), "[buildpack]\nid = \"org.example.node\"\n")
+			writeFile(filepath.Join(tmpDir, "bin", "build"), "")
+			writeFile(filepath.Join(tmpDir, "bin", "supply"), "")
+			Expect(c.IsCNB(tmpDir)).To(BeFalse())
+		})
+
+		It("is false for a v2 buildpack", func() {
+			writeFile(filepath.Join(tmpDir, "bin", "supply"), "")
+			Expect(c.IsCNB(tmpDir)).To(BeFalse())
+		})
+	})
+
+	Describe("TranslateCNBLayers", func() {
+		var depsIdxDir, layersDir string
+
+		BeforeEach(func() {
+			depsIdxDir = filepath.Join(tmpDir, "deps", "0")
+			layersDir = filepath.Join(depsIdxDir, "layers")
+
+			writeFile(filepath.Join(layersDir, "node.toml"), "launch = true\nbuild = true\ncache = true\n")
+			writeFile(filepath.Join(layersDir, "node", "bin", "node"), "#!/bin/sh\n")
+			writeFile(filepath.Join(layersDir, "node", "env", "NODE_HOME.override"), filepath.Join(layersDir, "node"))
+			writeFile(filepath.Join(layersDir, "node", "env", "NODE_OPTIONS.append"), "--max-old-space-size=512")
+			writeFile(filepath.Join(layersDir, "node", "env", "NODE_OPTIONS.delim"), " ")
+			writeFile(filepath.Join(layersDir, "node", "env.build", "NPM_CONFIG_PRODUCTION.default"), "false")
+			writeFile(filepath.Join(layersDir, "node", "env.launch", "NODE_ENV.default"), "production")
+
+			writeFile(filepath.Join(layersDir, "modules.toml"), "[types]\nlaunch = true\n")
+			writeFile(filepath.Join(layersDir, "modules", "bin", "tsc"), "#!/bin/sh\n")
+			writeFile(filepath.Join(layersDir, "modules", "env", "NODE_PATH"), filepath.Join(layersDir, "modules", "node_modules"))
+
+			writeFile(filepath.Join(layersDir, "npm-cache.toml"), "cache = true\n")
+			writeFile(filepath.Join(layersDir, "npm-cache", "index"), "")
+		})
+
+		JustBeforeEach(func() {
+			Expect(c.TranslateCNBLayers(depsIdxDir, "0", "0.2")).To(Succeed())
+		})
+
+		It("links the layers' bin dirs into the deps dir", func() {
+			Expect(os.Readlink(filepath.Join(depsIdxDir, "bin", "node"))).To(Equal(filepath.Join("..", "layers", "node", "bin", "node")))
+			Expect(os.Readlink(filepath.Join(depsIdxDir, "bin", "tsc"))).To(Equal(filepath.Join("..", "layers", "modules", "bin", "tsc")))
+		})
+
+		It("writes the build env of the build layers to the env dir", func() {
+			Expect(ioutil.ReadFile(filepath.Join(depsIdxDir, "env", "NODE_HOME"))).To(Equal([]byte(filepath.Join(layersDir, "node"))))
+			Expect(ioutil.ReadFile(filepath.Join(depsIdxDir, "env", "NPM_CONFIG_PRODUCTION"))).To(Equal([]byte("false")))
+			Expect(filepath.Join(depsIdxDir, "env", "NODE_PATH")).NotTo(BeAnExistingFile())
+			Expect(filepath.Join(depsIdxDir, "env", "NODE_ENV")).NotTo(BeAnExistingFile())
+		})
+
+		It("writes a profile.d script setting the launch env relative to DEPS_DIR", func() {
+			script := filepath.Join(depsIdxDir, "profile.d", c.CNBProfileScriptName)
+			cmd := exec.Command("bash", "-c", ". "+script+` && echo "$NODE_HOME|$NODE_OPTIONS|$NODE_PATH|$NODE_ENV|${NPM_CONFIG_PRODUCTION-unset}"`)
+			cmd.Env = []string{"DEPS_DIR=/home/vcap/deps", "NODE_OPTIONS=--inspect", "NODE_PATH=/app/lib"}
+			Expect(cmd.Output()).To(Equal([]byte("/home/vcap/deps/0/layers/node|--inspect --max-old-space-size=512|/home/vcap/deps/0/layers/modules/node_modules:/app/lib|production|unset\n")))
+		})
+
+		It("removes layers used for neither build nor launch", func() {
+			Expect(filepath.Join(layersDir, "npm-cache")).NotTo(BeADirectory())
+			Expect(filepath.Join(layersDir, "node")).To(BeADirectory())
+		})
+	})
+})
@@ -9,7 +9,6 @@ import (
 	"time"
 
 	"code.cloudfoundry.org/buildpackapplifecycle"
-	"code.cloudfoundry.org/buildpackapplifecycle/buildpackrunner"
 	"github.com/cloudfoundry/libbuildpack"
 )
 
@@ -19,16 +18,139 @@ type Runner interface {
 
 // MultiCompiler a struct to compile this buildpack
 type MultiCompiler struct {
-	BuildDir         string
-	CacheDir         string
-	Log              *libbuildpack.Logger
-	Buildpacks       []string
-	DownloadsDir     string
-	Runner           Runner
-	ExistingDepsDirs []string
+	BuildDir          string
+	CacheDir          string
+	Log               *libbuildpack.Logger
+	Buildpacks        []string
+	DownloadsDir      string
+	Runner            Runner
+	ExistingDepsDirs  []string
+	AppProfileScripts []string
+	CacheLimit        uint64
+	ClearCache        []string
+	StartFrom         string
+	Processes         map[string]string
+	MergeConfigVars   bool
+	BuildOnly         []int
+	Optional          []int
+	Decorators        []string
 }
 
 func main() {
+	// the binary runs as bin/compile, bin/detect or bin/release, chosen by
+	// its first argument; old scripts call it with just the compile args
+	command, args := "compile", os.Args[1:]
+	if len(args) > 0 {
+		switch args[0] {
+		case "compile", "detect", "release", "supply", "finalize", "migrate":
+			command, args = args[0], args[1:]
+		}
+	}
+
+	switch command {
+	case "detect":
+		detectMain(args)
+	case "release":
+		releaseMain(args)
+	case "supply":
+		supplyMain(args)
+	case "finalize":
+		finalizeMain(args)
+	case "migrate":
+		migrateMain(args)
+	default:
+		compileMain(args)
+	}
+}
+
+func detectMain(args []string) {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: detect <build-dir>")
+		os.Exit(1)
+	}
+	if err := Detect(args[0], os.Stdout, libbuildpack.NewLogger(os.Stderr)); err != nil {
+		os.Exit(1)
+	}
+}
+
+func releaseMain(args []string) {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: release <build-dir>")
+		os.Exit(1)
+	}
+	if err := Release(args[0], os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "**ERROR** Unable to release: %s\n", err.Error())
+		os.Exit(14)
+	}
+}
+
+func migrateMain(args []string) {
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Fprintln(os.Stderr, "Usage: migrate <app-dir> [<manifest.yml>]")
+		os.Exit(1)
+	}
+
+	manifestFile := DefaultManifestFile(args[0])
+	if len(args) == 2 {
+		manifestFile = args[1]
+	}
+
+	logger := libbuildpack.NewLogger(os.Stderr)
+	issues, err := Migrate(args[0], manifestFile, os.Stdout, logger)
+	if err != nil {
+		logger.Error("Unable to migrate %s: %s", manifestFile, err.Error())
+		os.Exit(1)
+	}
+
+	for _, issue := range issues {
+		logger.Warning("%s", issue)
+	}
+}
+
+func compileMain(args []string) {
+	mc, stager := newMultiCompilerFromArgs("compile", args)
+
+	err := mc.Compile()
+	if err != nil {
+		os.Exit(13)
+	}
+
+	stager.StagingComplete()
+}
+
+func supplyMain(args []string) {
+	if len(args) != 4 {
+		fmt.Fprintln(os.Stderr, "Usage: supply <build-dir> <cache-dir> <deps-dir> <deps-idx>")
+		os.Exit(1)
+	}
+
+	mc, stager := newMultiCompilerFromArgs("supply", args)
+
+	if err := mc.Supply(stager.DepsDir(), stager.DepsIdx()); err != nil {
+		os.Exit(15)
+	}
+}
+
+func finalizeMain(args []string) {
+	if len(args) != 5 {
+		fmt.Fprintln(os.Stderr, "Usage: finalize <build-dir> <cache-dir> <deps-dir> <deps-idx> <profile-dir>")
+		os.Exit(1)
+	}
+
+	mc, stager := newMultiCompilerFromArgs("finalize", args)
+
+	if err := mc.Finalize(stager.DepsDir(), stager.DepsIdx(), stager.ProfileDir()); err != nil {
+		os.Exit(16)
+	}
+
+	stager.StagingComplete()
+}
+
+// newMultiCompilerFromArgs sets up a MultiCompiler for command from the
+// buildpack's arguments and the app's multi-buildpack.yml, exiting on errors.
+// Supply and finalize share the nested downloads dir, and finalize reuses the
+// buildpacks supply resolved.
+func newMultiCompilerFromArgs(command string, args []string) (*MultiCompiler, *libbuildpack.Stager) {
 	logger := libbuildpack.NewLogger(os.Stdout)
 
 	buildpackDir, err := libbuildpack.GetBuildpackDir()
@@ -43,28 +165,73 @@ func main() {
 		os.Exit(9)
 	}
 
-	stager := libbuildpack.NewStager(os.Args[1:], logger, manifest)
+	stager := libbuildpack.NewStager(args, logger, manifest)
 	err = stager.CheckBuildpackValid()
 	if err != nil {
 		os.Exit(10)
 	}
 
-	buildpacks, err := GetBuildpacks(stager.BuildDir(), logger)
+	metadata, err := GetMultiBuildpackMetadata(stager.BuildDir(), logger)
 	if err != nil {
 		os.Exit(11)
 	}
+	logger.BeginStep("Using the buildpacks listed in %s", metadata.Source)
+	if len(metadata.Env) > 0 {
+		logger.Warning("The env section of %s is only used by the migrate command; set these variables with cf set-env instead", metadata.Source)
+	}
 
-	mc, err := NewMultiCompiler(stager.BuildDir(), stager.CacheDir(), buildpacks, logger)
+	services, err := ParseVCAPServices(os.Getenv("VCAP_SERVICES"))
 	if err != nil {
-		os.Exit(12)
+		logger.Error("Unable to parse VCAP_SERVICES: %s", err.Error())
+		os.Exit(11)
 	}
 
-	err = mc.Compile()
+	mc, err := NewMultiCompiler(stager.BuildDir(), stager.CacheDir(), metadata.Buildpacks, logger)
 	if err != nil {
-		os.Exit(13)
+		os.Exit(12)
+	}
+	if command == "supply" || command == "finalize" {
+		os.RemoveAll(mc.DownloadsDir)
+		mc.DownloadsDir = NestedDownloadsDir(stager.DepsIdx())
 	}
 
-	stager.StagingComplete()
+	resolvedFile := filepath.Join(mc.DownloadsDir, ResolvedBuildpacksFile)
+	loaded := false
+	if command == "finalize" {
+		if loaded, err = metadata.LoadResolved(resolvedFile); err != nil {
+			logger.Error("Unable to read the buildpacks resolved by supply: %s", err.Error())
+			os.Exit(12)
+		}
+		mc.Buildpacks = metadata.Buildpacks
+	}
+	if !loaded {
+		if err := mc.ResolveBuildpacks(metadata, services); err != nil {
+			os.Exit(12)
+		}
+	}
+	if command == "supply" {
+		if err := metadata.SaveResolved(resolvedFile); err != nil {
+			logger.Error("Unable to save the resolved buildpacks: %s", err.Error())
+			os.Exit(12)
+		}
+	}
+	mc.CacheLimit, _ = metadata.CacheLimit()
+	envClearCache := ParseClearCache(os.Getenv("MULTI_BUILDPACK_CLEAR_CACHE"))
+	mc.ClearCache = []string{}
+	for _, target := range append(ParseClearCache(metadata.Cache.Clear), envClearCache...) {
+		mc.ClearCache = append(mc.ClearCache, metadata.ListedIndex(target))
+	}
+	if len(envClearCache) > 0 {
+		logger.Warning("MULTI_BUILDPACK_CLEAR_CACHE is set, so caches are cleared on every staging. Unset it once they are cleared: cf unset-env <app> MULTI_BUILDPACK_CLEAR_CACHE")
+	}
+	mc.StartFrom = metadata.ListedIndex(metadata.StartFrom)
+	mc.Processes = metadata.Processes
+	mc.MergeConfigVars = metadata.MergeConfigVars
+	mc.BuildOnly = metadata.BuildOnlyIndexes()
+	mc.Optional = metadata.OptionalIndexes()
+	mc.Decorators = metadata.Decorators
+
+	return mc, stager
 }
 
 // NewMultiCompiler creates a new MultiCompiler
@@ -74,13 +241,14 @@ func NewMultiCompiler(buildDir, cacheDir string, buildpacks []string, logger *li
 		return nil, err
 	}
 	mc := &MultiCompiler{
-		BuildDir:         buildDir,
-		CacheDir:         cacheDir,
-		Buildpacks:       buildpacks,
-		DownloadsDir:     downloadsDir,
-		Log:              logger,
-		Runner:           nil,
-		ExistingDepsDirs: []string{},
+		BuildDir:          buildDir,
+		CacheDir:          cacheDir,
+		Buildpacks:        buildpacks,
+		DownloadsDir:      downloadsDir,
+		Log:               logger,
+		Runner:            nil,
+		ExistingDepsDirs:  []string{},
+		AppProfileScripts: []string{},
 	}
 	return mc, nil
 }
@@ -93,23 +261,35 @@ func (c *MultiCompiler) Compile() error {
 		return err
 	}
 
+	if err := RemoveRelease(c.BuildDir); err != nil {
+		c.Log.Error("Unable to remove the previous release: %s", err.Error())
+		return err
+	}
+
 	c.ExistingDepsDirs, err = filepath.Glob(filepath.Join(os.TempDir(), "contents*", "deps"))
 	if err != nil {
 		c.Log.Error("Unable to locate directories: %s", err.Error())
 		return err
 	}
 
-	c.Runner = buildpackrunner.New(&config)
-
-	stagingInfoFile, err := c.RunBuildpacks()
+	c.AppProfileScripts, err = ListProfileScripts(filepath.Join(c.BuildDir, ".profile.d"))
 	if err != nil {
-		c.Log.Error("Unable to run all buildpacks: %s", err.Error())
+		c.Log.Error("Unable to read .profile.d: %s", err.Error())
 		return err
 	}
 
-	err = WriteStartCommand(stagingInfoFile, "/tmp/multi-buildpack-release.yml")
+	cache := NewBuildpackCache(config.BuildArtifactsCacheDir(), c.CacheLimit, c.ClearCache, c.Log)
+	runner := NewBuildpackRunner(&config, cache, c.Log)
+	runner.StartFrom = c.StartFrom
+	runner.Processes = c.Processes
+	runner.MergeConfigVars = c.MergeConfigVars
+	runner.Optional = c.Optional
+	runner.Decorators = c.Decorators
+	c.Runner = runner
+
+	stagingInfoFile, err := c.RunBuildpacks()
 	if err != nil {
-		c.Log.Error("Unable to write start command: %s", err.Error())
+		c.Log.Error("Unable to run all buildpacks: %s", err.Error())
 		return err
 	}
 
@@ -119,28 +299,25 @@ func (c *MultiCompiler) Compile() error {
 		return err
 	}
 
-	profiledDir := filepath.Join(c.BuildDir, ".profile.d")
-	err = os.MkdirAll(profiledDir, 0755)
-	if err != nil {
+	if err := c.RemoveBuildOnlyDeps(filepath.Join(c.BuildDir, ".deps"), filepath.Join(c.BuildDir, ".profile.d"), installedProfileScriptName(c.finalDepsIndex(), "")); err != nil {
+		c.Log.Error("Unable to remove build-only buildpacks: %s", err.Error())
 		return err
 	}
 
-	profileScript := `
-	set -e
-
-	if [ -d .deps ]; then
-		mkdir -p ../deps
-		mv .deps/* ../deps/
-		rm -rf .deps
-	fi
-	DIR=$(dirname $HOME)
-	export DEPS_DIR=$DIR/deps
-	`
+	if err := WriteMultiProfileScript(filepath.Join(c.BuildDir, ".profile.d")); err != nil {
+		c.Log.Error("Unable to create .profile.d/%s script: %s", MultiProfileScriptName, err.Error())
+		return err
+	}
 
-	err = ioutil.WriteFile(filepath.Join(profiledDir, "00000000_multi.sh"), []byte(profileScript), 0755)
+	if err := c.WriteDepsInfo(); err != nil {
+		c.Log.Error("Unable to write deps info: %s", err.Error())
+		return err
+	}
 
+	// written last, so bin/release only finds it once compile has succeeded
+	err = WriteStartCommand(stagingInfoFile, c.BuildDir)
 	if err != nil {
-		c.Log.Error("Unable create .profile.d/00000000_multi.sh script: %s", err.Error())
+		c.Log.Error("Unable to write start command: %s", err.Error())
 		return err
 	}
 
@@ -152,6 +329,9 @@ func (c *MultiCompiler) NewLifecycleBuilderConfig() (buildpackapplifecycle.Lifec
 	if err := cfg.Set("buildpacksDir", c.DownloadsDir); err != nil {
 		return cfg, err
 	}
+	if err := cfg.Set("buildpacksDownloadDir", c.DownloadsDir); err != nil {
+		return cfg, err
+	}
 	if err := cfg.Set("buildpackOrder", strings.Join(c.Buildpacks, ",")); err != nil {
 		return cfg, err
 	}
@@ -180,9 +360,16 @@ func (c *MultiCompiler) RunBuildpacks() (string, error) {
 	}
 
 	c.Log.BeginStep("Running buildpacks:")
-	c.Log.Info(strings.Join(c.Buildpacks, "\n"))
+	c.Log.Info("%s", strings.Join(c.Buildpacks, "\n"))
 
-	return c.Runner.Run()
+	start := time.Now()
+	stagingInfoFile, err := c.Runner.Run()
+	if err != nil {
+		return "", err
+	}
+
+	c.Log.BeginStep("Ran buildpacks in %s", time.Since(start).Round(time.Second))
+	return stagingInfoFile, nil
 }
 
 // CleanupStagingArea moves prepares the staging container to be tarred by the old lifecycle
@@ -201,26 +388,20 @@ func (c *MultiCompiler) CleanupStagingArea() error {
 	if len(depsDirs) != 1 {
 		return fmt.Errorf("found %d deps dirs, expected 1", len(depsDirs))
 	}
-	if err := os.Rename(depsDirs[0], filepath.Join(c.BuildDir, ".deps")); err != nil {
+	buildDepsDir := filepath.Join(c.BuildDir, ".deps")
+	if err := MovePath(depsDirs[0], buildDepsDir, c.Log); err != nil {
+		return err
+	}
+	if err := RelocateDeps(buildDepsDir, depsDirs[0], c.Log); err != nil {
 		return err
 	}
 
 	profileDir := filepath.Join(depsDirs[0], "..", "profile.d")
-	if exists, err := libbuildpack.FileExists(profileDir); err != nil {
+	if err := RelocateProfileScripts(profileDir, depsDirs[0], c.Log); err != nil {
+		return err
+	}
+	if err := c.InstallProfileScripts(profileDir); err != nil {
 		return err
-	} else if exists {
-		if err := os.MkdirAll(filepath.Join(c.BuildDir, ".profile.d"), 0755); err != nil {
-			return err
-		}
-		files, err := ioutil.ReadDir(profileDir)
-		if err != nil {
-			return err
-		}
-		for _, file := range files {
-			if err := os.Rename(filepath.Join(profileDir, file.Name()), filepath.Join(c.BuildDir, ".profile.d", file.Name())); err != nil {
-				return err
-			}
-		}
 	}
 
 	return nil
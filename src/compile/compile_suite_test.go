@@ -1,6 +1,10 @@
 package main_test
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
@@ -11,3 +15,21 @@ func TestCompile(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "Compile Suite")
 }
+
+// writeFile writes an executable file, creating its dir
+func writeFile(path, contents string) {
+	Expect(os.MkdirAll(filepath.Dir(path), 0755)).To(Succeed())
+	Expect(ioutil.WriteFile(path, []byte(contents), 0755)).To(Succeed())
+}
+
+// writeBuildpack writes a buildpack into dir with the given bin scripts, and
+// a manifest.yml naming its language unless language is empty
+func writeBuildpack(dir, language string, scripts map[string]string) {
+	Expect(os.MkdirAll(filepath.Join(dir, "bin"), 0755)).To(Succeed())
+	if language != "" {
+		writeFile(filepath.Join(dir, "manifest.yml"), "language: "+language+"\n")
+	}
+	for script, contents := range scripts {
+		writeFile(filepath.Join(dir, "bin", script), "#!/usr/bin/env bash\nset -e\n"+contents)
+	}
+}
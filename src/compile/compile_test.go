@@ -86,6 +86,7 @@ var _ = Describe("Compile", func() {
 			Expect(config.BuildpackOrder()).To(Equal(buildpacks))
 			Expect(config.OutputDroplet()).To(Equal("/dev/null"))
 			Expect(config.BuildpacksDir()).To(Equal(downloadsDir))
+			Expect(config.BuildpacksDownloadDir()).To(Equal(downloadsDir))
 			Expect(config.BuildArtifactsCacheDir()).To(Equal(cacheDir))
 		})
 	})
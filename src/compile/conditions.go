@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/cloudfoundry/libbuildpack"
+)
+
+// BuildpackCondition is the when section of a buildpacks entry. Every
+// condition set must hold for the buildpack to run.
+type BuildpackCondition struct {
+	// ServiceLabel requires a bound service with this label, e.g. newrelic
+	ServiceLabel string `yaml:"service_label"`
+	// ServiceTag requires a bound service with this tag, e.g. postgres
+	ServiceTag string `yaml:"service_tag"`
+	// FileExists requires a file matching this pattern in the app, e.g.
+	// package.json
+	FileExists string `yaml:"file_exists"`
+}
+
+// VCAPService is a service bound to the app, as listed in VCAP_SERVICES
+type VCAPService struct {
+	Name  string   `json:"name"`
+	Label string   `json:"label"`
+	Tags  []string `json:"tags"`
+}
+
+// ParseVCAPServices returns the services bound to the app from the contents
+// of VCAP_SERVICES
+func ParseVCAPServices(vcapServices string) ([]VCAPService, error) {
+	services := []VCAPService{}
+	if vcapServices == "" {
+		return services, nil
+	}
+
+	byLabel := map[string][]VCAPService{}
+	if err := json.Unmarshal([]byte(vcapServices), &byLabel); err != nil {
+		return nil, err
+	}
+
+	for label, instances := range byLabel {
+		for _, service := range instances {
+			if service.Label == "" {
+				service.Label = label
+			}
+			services = append(services, service)
+		}
+	}
+	return services, nil
+}
+
+// ResolveBuildpacks narrows the buildpacks of metadata down to those that
+// apply to the app: the ones whose when conditions hold and, in auto mode,
+// whose bin/detect passes. The final buildpack is always kept, or picked from
+// the final_candidates by detection.
+func (c *MultiCompiler) ResolveBuildpacks(metadata *MultiBuildpackMetadata, services []VCAPService) error {
+	metadata.listed = entryURLs(metadata.Entries)
+	for i := range metadata.Entries {
+		metadata.Entries[i].position = i
+	}
+
+	metadata.SelectBuildpacks(c.BuildDir, services, c.Log)
+
+	hasCandidates := len(metadata.FinalCandidates) > 0
+	if metadata.Auto || hasCandidates {
+		detector, err := c.newDetector(append(append([]string{}, metadata.Buildpacks...), metadata.FinalCandidates...))
+		if err != nil {
+			c.Log.Error("Unable to set up runner config: %s", err.Error())
+			return err
+		}
+
+		if metadata.Auto {
+			if metadata.Entries, err = c.detectBuildpacks(detector, metadata.Entries, !hasCandidates); err != nil {
+				return err
+			}
+		}
+
+		if hasCandidates {
+			final, err := c.detectFinalBuildpack(detector, metadata.FinalCandidates)
+			if err != nil {
+				return err
+			}
+			metadata.Entries = append(metadata.Entries, BuildpackEntry{URL: final, position: len(metadata.listed)})
+		}
+
+		metadata.Buildpacks = entryURLs(metadata.Entries)
+	}
+
+	if metadata.Auto || hasCandidates || len(metadata.Buildpacks) != len(c.Buildpacks) {
+		c.Log.BeginStep("Resolved buildpacks:")
+		c.Log.Info("%s", strings.Join(metadata.Buildpacks, "\n"))
+	}
+	c.Buildpacks = metadata.Buildpacks
+	return nil
+}
+
+// ResolvedBuildpacksFile is where supply saves the buildpacks it resolved,
+// in the nested downloads dir, for finalize
+const ResolvedBuildpacksFile = "resolved-buildpacks.yml"
+
+// resolvedBuildpacks is the part of MultiBuildpackMetadata that
+// ResolveBuildpacks settles
+type resolvedBuildpacks struct {
+	Entries []resolvedEntry `yaml:"buildpacks"`
+	Listed  []string        `yaml:"listed"`
+}
+
+type resolvedEntry struct {
+	URL       string `yaml:"url"`
+	BuildOnly bool   `yaml:"build_only"`
+	Optional  bool   `yaml:"optional"`
+	Position  int    `yaml:"position"`
+}
+
+// SaveResolved writes the buildpacks ResolveBuildpacks settled on to path
+func (m *MultiBuildpackMetadata) SaveResolved(path string) error {
+	resolved := resolvedBuildpacks{Entries: []resolvedEntry{}, Listed: m.listed}
+	for _, entry := range m.Entries {
+		resolved.Entries = append(resolved.Entries, resolvedEntry{URL: entry.URL, BuildOnly: entry.BuildOnly, Optional: entry.Optional, Position: entry.position})
+	}
+	return libbuildpack.NewYAML().Write(path, resolved)
+}
+
+// LoadResolved replaces the buildpacks with those saved by SaveResolved, so
+// they are not resolved again. It returns false when path does not exist.
+func (m *MultiBuildpackMetadata) LoadResolved(path string) (bool, error) {
+	resolved := resolvedBuildpacks{}
+	if err := libbuildpack.NewYAML().Load(path, &resolved); os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	m.Entries = []BuildpackEntry{}
+	for _, entry := range resolved.Entries {
+		m.Entries = append(m.Entries, BuildpackEntry{URL: entry.URL, BuildOnly: entry.BuildOnly, Optional: entry.Optional, position: entry.Position})
+	}
+	m.Buildpacks = entryURLs(m.Entries)
+	m.listed = resolved.Listed
+	return true, nil
+}
+
+// ListedIndex maps a buildpack index, counted in the buildpacks list as
+// written with the chosen final candidate after it, to the index of that
+// buildpack once ResolveBuildpacks has run. The index of a buildpack that was
+// left out becomes its URL. Targets that are not indexes are kept.
+func (m *MultiBuildpackMetadata) ListedIndex(target string) string {
+	idx, err := strconv.Atoi(target)
+	if err != nil || m.listed == nil {
+		return target
+	}
+
+	for i, entry := range m.Entries {
+		if entry.position == idx {
+			return strconv.Itoa(i)
+		}
+	}
+	if idx >= 0 && idx < len(m.listed) {
+		return m.listed[idx]
+	}
+	return target
+}
+
+// newDetector returns a runner that can download and detect the buildpacks
+func (c *MultiCompiler) newDetector(buildpacks []string) (*BuildpackRunner, error) {
+	detector := *c
+	detector.Buildpacks = buildpacks
+	config, err := detector.NewLifecycleBuilderConfig()
+	if err != nil {
+		return nil, err
+	}
+	return NewBuildpackRunner(&config, nil, c.Log), nil
+}
+
+// detectBuildpacks returns the entries whose bin/detect passes, and the
+// final one if keepFinal is set
+func (c *MultiCompiler) detectBuildpacks(detector *BuildpackRunner, entries []BuildpackEntry, keepFinal bool) ([]BuildpackEntry, error) {
+	detected := []BuildpackEntry{}
+	for i, entry := range entries {
+		if keepFinal && i == len(entries)-1 {
+			detected = append(detected, entry)
+			continue
+		}
+
+		passed, err := detector.DetectBuildpack(entry.URL)
+		if err != nil {
+			if !entry.Optional {
+				c.Log.Error("Unable to detect buildpack %s: %s", entry.URL, err.Error())
+				return nil, err
+			}
+			c.Log.Warning("Skipping optional buildpack %s: %s", entry.URL, err.Error())
+			continue
+		}
+		if !passed {
+			c.Log.Info("Skipping buildpack %s: it does not detect the app", entry.URL)
+			continue
+		}
+		detected = append(detected, entry)
+	}
+	return detected, nil
+}
+
+// detectFinalBuildpack returns the first candidate whose bin/detect passes.
+// Like the lifecycle's detection, candidates that cannot be downloaded or
+// detected are passed over.
+func (c *MultiCompiler) detectFinalBuildpack(detector *BuildpackRunner, candidates []string) (string, error) {
+	for _, candidate := range candidates {
+		passed, err := detector.DetectBuildpack(candidate)
+		if err != nil {
+			c.Log.Warning("Unable to detect final candidate %s: %s", candidate, err.Error())
+			continue
+		}
+		if passed {
+			c.Log.Info("Using %s as the final buildpack", candidate)
+			return candidate, nil
+		}
+	}
+
+	c.Log.Error("None of the final_candidates detect the app:\n%s", strings.Join(candidates, "\n"))
+	return "", errors.New("no final candidate detects the app")
+}
+
+// SelectBuildpacks drops the buildpacks whose when conditions do not hold
+// for the app in buildDir and the bound services, logging each one skipped
+func (m *MultiBuildpackMetadata) SelectBuildpacks(buildDir string, services []VCAPService, logger *libbuildpack.Logger) {
+	entries := []BuildpackEntry{}
+	for _, entry := range m.Entries {
+		if entry.When != nil {
+			if reason := entry.When.unmet(buildDir, services); reason != "" {
+				logger.Info("Skipping buildpack %s: %s", entry.URL, reason)
+				continue
+			}
+		}
+		entries = append(entries, entry)
+	}
+
+	m.Entries = entries
+	m.Buildpacks = entryURLs(entries)
+}
+
+// unmet returns why the condition does not hold, or "" if it does
+func (cond *BuildpackCondition) unmet(buildDir string, services []VCAPService) string {
+	if cond.ServiceLabel != "" && !hasService(services, func(service VCAPService) bool { return service.Label == cond.ServiceLabel }) {
+		return fmt.Sprintf("no bound service has the label %s", cond.ServiceLabel)
+	}
+
+	if cond.ServiceTag != "" && !hasService(services, func(service VCAPService) bool { return containsString(service.Tags, cond.ServiceTag) }) {
+		return fmt.Sprintf("no bound service has the tag %s", cond.ServiceTag)
+	}
+
+	if cond.FileExists != "" {
+		if matches, err := filepath.Glob(filepath.Join(buildDir, cond.FileExists)); err != nil || len(matches) == 0 {
+			return fmt.Sprintf("the app has no %s", cond.FileExists)
+		}
+	}
+
+	return ""
+}
+
+func hasService(services []VCAPService, match func(VCAPService) bool) bool {
+	for _, service := range services {
+		if match(service) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,272 @@
+package main_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	c "compile"
+
+	"github.com/cloudfoundry/libbuildpack"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Conditions", func() {
+	var (
+		err      error
+		buildDir string
+		buffer   *bytes.Buffer
+		logger   *libbuildpack.Logger
+	)
+
+	BeforeEach(func() {
+		buildDir, err = ioutil.TempDir("", "build")
+		Expect(err).To(BeNil())
+
+		buffer = new(bytes.Buffer)
+		logger = libbuildpack.NewLogger(buffer)
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(buildDir)).To(Succeed())
+	})
+
+	Describe("ParseVCAPServices", func() {
+		It("returns the bound services with their labels", func() {
+			services, err := c.ParseVCAPServices(`{"newrelic":[{"name":"apm","tags":["apm"]}],"user-provided":[{"name":"db","label":"user-provided","tags":["postgres","sql"]}]}`)
+			Expect(err).To(BeNil())
+			Expect(services).To(ConsistOf(
+				c.VCAPService{Name: "apm", Label: "newrelic", Tags: []string{"apm"}},
+				c.VCAPService{Name: "db", Label: "user-provided", Tags: []string{"postgres", "sql"}},
+			))
+		})
+
+		It("returns no services when VCAP_SERVICES is empty", func() {
+			Expect(c.ParseVCAPServices("")).To(BeEmpty())
+		})
+
+		It("returns an error when VCAP_SERVICES is malformed", func() {
+			_, err := c.ParseVCAPServices("{")
+			Expect(err).NotTo(BeNil())
+		})
+	})
+
+	Describe("SelectBuildpacks", func() {
+		var metadata *c.MultiBuildpackMetadata
+
+		BeforeEach(func() {
+			metadata = &c.MultiBuildpackMetadata{
+				Entries: []c.BuildpackEntry{
+					{URL: "https://example.com/newrelic-buildpack", When: &c.BuildpackCondition{ServiceLabel: "newrelic"}},
+					{URL: "https://example.com/pg-client-buildpack", When: &c.BuildpackCondition{ServiceTag: "postgres"}},
+					{URL: "https://example.com/mysql-client-buildpack", When: &c.BuildpackCondition{ServiceTag: "mysql"}},
+					{URL: "https://github.com/cloudfoundry/ruby-buildpack"},
+				},
+			}
+		})
+
+		It("keeps the buildpacks whose conditions hold", func() {
+			metadata.SelectBuildpacks(buildDir, []c.VCAPService{
+				{Name: "apm", Label: "newrelic"},
+				{Name: "db", Label: "elephantsql", Tags: []string{"postgres"}},
+			}, logger)
+
+			Expect(metadata.Buildpacks).To(Equal([]string{"https://example.com/newrelic-buildpack", "https://example.com/pg-client-buildpack", "https://github.com/cloudfoundry/ruby-buildpack"}))
+			Expect(metadata.Entries).To(HaveLen(3))
+		})
+
+		It("logs the buildpacks skipped", func() {
+			metadata.SelectBuildpacks(buildDir, []c.VCAPService{}, logger)
+
+			Expect(metadata.Buildpacks).To(Equal([]string{"https://github.com/cloudfoundry/ruby-buildpack"}))
+			Expect(buffer.String()).To(ContainSubstring("Skipping buildpack https://example.com/newrelic-buildpack: no bound service has the label newrelic"))
+			Expect(buffer.String()).To(ContainSubstring("Skipping buildpack https://example.com/pg-client-buildpack: no bound service has the tag postgres"))
+		})
+
+		It("keeps the buildpacks whose files exist in the app", func() {
+			Expect(ioutil.WriteFile(filepath.Join(buildDir, "package.json"), []byte("{}"), 0644)).To(Succeed())
+			metadata.Entries[0].When = &c.BuildpackCondition{FileExists: "package.json"}
+			metadata.Entries[1].When = &c.BuildpackCondition{FileExists: "*.csproj"}
+			metadata.SelectBuildpacks(buildDir, []c.VCAPService{}, logger)
+
+			Expect(metadata.Buildpacks).To(Equal([]string{"https://example.com/newrelic-buildpack", "https://github.com/cloudfoundry/ruby-buildpack"}))
+			Expect(buffer.String()).To(ContainSubstring("Skipping buildpack https://example.com/pg-client-buildpack: the app has no *.csproj"))
+		})
+
+		It("requires every condition to hold", func() {
+			metadata.Entries[0].When.ServiceTag = "apm"
+			metadata.SelectBuildpacks(buildDir, []c.VCAPService{{Name: "apm", Label: "newrelic"}}, logger)
+
+			Expect(metadata.Buildpacks).NotTo(ContainElement("https://example.com/newrelic-buildpack"))
+		})
+	})
+
+	Describe("ResolveBuildpacks", func() {
+		var (
+			downloadsDir string
+			cacheDir     string
+			compiler     *c.MultiCompiler
+			metadata     *c.MultiBuildpackMetadata
+		)
+
+		writeDetectBuildpack := func(name, detect string) {
+			config, err := compiler.NewLifecycleBuilderConfig()
+			Expect(err).To(BeNil())
+			scripts := map[string]string{}
+			if detect != "" {
+				scripts["detect"] = detect
+			}
+			writeBuildpack(config.BuildpackPath(name), "", scripts)
+		}
+
+		BeforeEach(func() {
+			downloadsDir, err = ioutil.TempDir("", "downloads")
+			Expect(err).To(BeNil())
+			cacheDir, err = ioutil.TempDir("", "cache")
+			Expect(err).To(BeNil())
+
+			metadata = &c.MultiBuildpackMetadata{
+				Entries: []c.BuildpackEntry{
+					{URL: "nodejs_buildpack"},
+					{URL: "python_buildpack"},
+					{URL: "no_detect_buildpack"},
+					{URL: "ruby_buildpack"},
+				},
+				Buildpacks: []string{"nodejs_buildpack", "python_buildpack", "no_detect_buildpack", "ruby_buildpack"},
+			}
+			compiler = &c.MultiCompiler{
+				BuildDir:     buildDir,
+				CacheDir:     cacheDir,
+				Buildpacks:   metadata.Buildpacks,
+				DownloadsDir: downloadsDir,
+				Log:          logger,
+			}
+
+			writeDetectBuildpack("nodejs_buildpack", `[ -f "$1/package.json" ]`)
+			writeDetectBuildpack("python_buildpack", `[ -f "$1/requirements.txt" ]`)
+			writeDetectBuildpack("no_detect_buildpack", "")
+			writeDetectBuildpack("ruby_buildpack", "exit 1")
+			writeDetectBuildpack("go_buildpack", "exit 0")
+			Expect(ioutil.WriteFile(filepath.Join(buildDir, "package.json"), []byte("{}"), 0644)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(downloadsDir)).To(Succeed())
+			Expect(os.RemoveAll(cacheDir)).To(Succeed())
+		})
+
+		Context("auto is set", func() {
+			BeforeEach(func() {
+				metadata.Auto = true
+			})
+
+			It("keeps the buildpacks that detect the app, and the final one", func() {
+				Expect(compiler.ResolveBuildpacks(metadata, []c.VCAPService{})).To(Succeed())
+
+				Expect(compiler.Buildpacks).To(Equal([]string{"nodejs_buildpack", "ruby_buildpack"}))
+				Expect(metadata.Entries).To(HaveLen(2))
+			})
+
+			It("prints the resolved buildpacks", func() {
+				Expect(compiler.ResolveBuildpacks(metadata, []c.VCAPService{})).To(Succeed())
+
+				Expect(buffer.String()).To(ContainSubstring("Skipping buildpack python_buildpack: it does not detect the app"))
+				Expect(buffer.String()).To(ContainSubstring("Resolved buildpacks:\n       nodejs_buildpack\n       ruby_buildpack\n"))
+			})
+
+			It("maps indexes in the buildpacks list to the resolved buildpacks", func() {
+				Expect(compiler.ResolveBuildpacks(metadata, []c.VCAPService{})).To(Succeed())
+
+				Expect(metadata.ListedIndex("0")).To(Equal("0"))
+				Expect(metadata.ListedIndex("3")).To(Equal("1"))
+				Expect(metadata.ListedIndex("1")).To(Equal("python_buildpack"))
+				Expect(metadata.ListedIndex("7")).To(Equal("7"))
+				Expect(metadata.ListedIndex("ruby")).To(Equal("ruby"))
+			})
+		})
+
+		Context("final_candidates are set", func() {
+			BeforeEach(func() {
+				metadata.Entries = metadata.Entries[:2]
+				metadata.Buildpacks = metadata.Buildpacks[:2]
+				metadata.FinalCandidates = []string{"ruby_buildpack", "missing_buildpack", "go_buildpack"}
+				compiler.Buildpacks = metadata.Buildpacks
+			})
+
+			It("adds the first candidate that detects the app as the final buildpack", func() {
+				Expect(compiler.ResolveBuildpacks(metadata, []c.VCAPService{})).To(Succeed())
+
+				Expect(compiler.Buildpacks).To(Equal([]string{"nodejs_buildpack", "python_buildpack", "go_buildpack"}))
+				Expect(buffer.String()).To(ContainSubstring("Unable to detect final candidate missing_buildpack"))
+				Expect(buffer.String()).To(ContainSubstring("Using go_buildpack as the final buildpack"))
+				Expect(buffer.String()).To(ContainSubstring("Resolved buildpacks:\n       nodejs_buildpack\n       python_buildpack\n       go_buildpack\n"))
+			})
+
+			Context("auto is set", func() {
+				BeforeEach(func() {
+					metadata.Auto = true
+				})
+
+				It("detects every listed buildpack", func() {
+					Expect(compiler.ResolveBuildpacks(metadata, []c.VCAPService{})).To(Succeed())
+
+					Expect(compiler.Buildpacks).To(Equal([]string{"nodejs_buildpack", "go_buildpack"}))
+				})
+
+				It("maps the index after the buildpacks list to the final buildpack", func() {
+					Expect(compiler.ResolveBuildpacks(metadata, []c.VCAPService{})).To(Succeed())
+
+					Expect(metadata.ListedIndex("2")).To(Equal("1"))
+				})
+			})
+
+			Context("no candidate detects the app", func() {
+				BeforeEach(func() {
+					metadata.FinalCandidates = []string{"ruby_buildpack", "python_buildpack"}
+				})
+
+				It("returns an error and informs the user", func() {
+					Expect(compiler.ResolveBuildpacks(metadata, []c.VCAPService{})).NotTo(Succeed())
+
+					Expect(buffer.String()).To(ContainSubstring("None of the final_candidates detect the app:\n       ruby_buildpack\n       python_buildpack"))
+				})
+			})
+		})
+
+		Describe("SaveResolved", func() {
+			BeforeEach(func() {
+				metadata.Auto = true
+				metadata.Entries[3].BuildOnly = true
+			})
+
+			It("saves the resolved buildpacks for LoadResolved", func() {
+				Expect(compiler.ResolveBuildpacks(metadata, []c.VCAPService{})).To(Succeed())
+				resolvedFile := filepath.Join(downloadsDir, c.ResolvedBuildpacksFile)
+				Expect(metadata.SaveResolved(resolvedFile)).To(Succeed())
+
+				loaded := &c.MultiBuildpackMetadata{Entries: []c.BuildpackEntry{{URL: "go_buildpack"}}}
+				Expect(loaded.LoadResolved(resolvedFile)).To(BeTrue())
+
+				Expect(loaded.Buildpacks).To(Equal([]string{"nodejs_buildpack", "ruby_buildpack"}))
+				Expect(loaded.BuildOnlyIndexes()).To(Equal([]int{1}))
+				Expect(loaded.ListedIndex("3")).To(Equal("1"))
+			})
+
+			It("loads nothing when supply saved nothing", func() {
+				Expect(metadata.LoadResolved(filepath.Join(downloadsDir, c.ResolvedBuildpacksFile))).To(BeFalse())
+				Expect(metadata.Buildpacks).To(HaveLen(4))
+			})
+		})
+
+		Context("auto is not set", func() {
+			It("keeps every buildpack without a when condition", func() {
+				Expect(compiler.ResolveBuildpacks(metadata, []c.VCAPService{})).To(Succeed())
+
+				Expect(compiler.Buildpacks).To(Equal([]string{"nodejs_buildpack", "python_buildpack", "no_detect_buildpack", "ruby_buildpack"}))
+				Expect(buffer.String()).To(Equal(""))
+			})
+		})
+	})
+})
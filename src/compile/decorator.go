@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/cloudfoundry/libbuildpack"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// DecoratorRelease is the output of a decorator's optional bin/release
+type DecoratorRelease struct {
+	// CommandPrefix wraps the command of every process type, e.g.
+	// `newrelic-admin run-program`
+	CommandPrefix string `yaml:"command_prefix"`
+}
+
+// runDecorators runs bin/decorate of each decorator after the final buildpack
+// and returns the command prefixes given by their releases, in order
+func (r *BuildpackRunner) runDecorators() ([]string, error) {
+	prefixes := []string{}
+	for _, decorator := range r.Decorators {
+		r.log.BeginStep("Running decorator %s", decorator)
+
+		if err := r.downloadBuildpack(decorator); err != nil {
+			return nil, fmt.Errorf("Failed to download decorator %s: %s", decorator, err.Error())
+		}
+		decoratorPath, err := r.buildpackPath(decorator)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to run decorator %s: %s", decorator, err.Error())
+		}
+
+		if err := r.run(exec.Command(filepath.Join(decoratorPath, "bin", "decorate"), r.config.BuildDir(), r.depsDir, r.profileDir)); err != nil {
+			return nil, fmt.Errorf("Failed to run decorator %s: %s", decorator, err.Error())
+		}
+
+		if exists, err := libbuildpack.FileExists(filepath.Join(decoratorPath, "bin", "release")); err != nil {
+			return nil, err
+		} else if !exists {
+			continue
+		}
+
+		output := new(bytes.Buffer)
+		cmd := exec.Command(filepath.Join(decoratorPath, "bin", "release"), r.config.BuildDir())
+		cmd.Stdout = output
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return nil, fmt.Errorf("Failed to run the release of decorator %s: %s", decorator, err.Error())
+		}
+
+		release := DecoratorRelease{}
+		if err := yaml.Unmarshal(output.Bytes(), &release); err != nil {
+			return nil, fmt.Errorf("decorator %s release output invalid: %s", decorator, err.Error())
+		}
+		if release.CommandPrefix != "" {
+			prefixes = append(prefixes, release.CommandPrefix)
+		}
+	}
+	return prefixes, nil
+}
+
+// WrapProcessTypes prefixes the command of every process type with each
+// prefix in turn, so the last prefix ends up outermost
+func WrapProcessTypes(processTypes map[string]string, prefixes []string) map[string]string {
+	if len(prefixes) == 0 {
+		return processTypes
+	}
+
+	wrapped := map[string]string{}
+	for name, command := range processTypes {
+		for _, prefix := range prefixes {
+			if command != "" {
+				command = prefix + " " + command
+			}
+		}
+		wrapped[name] = command
+	}
+	return wrapped
+}
@@ -0,0 +1,24 @@
+package main_test
+
+import (
+	c "compile"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("WrapProcessTypes", func() {
+	It("prefixes every command, the last prefix outermost", func() {
+		processTypes := map[string]string{"web": "bundle exec rails s", "worker": "bundle exec sidekiq", "none": ""}
+
+		Expect(c.WrapProcessTypes(processTypes, []string{"newrelic-admin run-program", "with-certs"})).To(Equal(map[string]string{
+			"web":    "with-certs newrelic-admin run-program bundle exec rails s",
+			"worker": "with-certs newrelic-admin run-program bundle exec sidekiq",
+			"none":   "",
+		}))
+	})
+
+	It("leaves the commands alone without prefixes", func() {
+		Expect(c.WrapProcessTypes(map[string]string{"web": "./start"}, []string{})).To(Equal(map[string]string{"web": "./start"}))
+	})
+})
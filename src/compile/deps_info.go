@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cloudfoundry/libbuildpack"
+)
+
+// DepsProfileScriptName runs right after the MultiProfileScript has set
+// DEPS_DIR, and before the buildpack scripts. It sorts after
+// MultiProfileScriptName whether or not the locale ignores punctuation.
+const DepsProfileScriptName = "00000000_multi_vars.sh"
+
+var invalidEnvVarChars = regexp.MustCompile(`[^A-Z0-9]+`)
+
+// DepsInfo describes the buildpack that supplied a deps dir
+type DepsInfo struct {
+	Name      string `json:"name"`
+	Version   string `json:"version,omitempty"`
+	Buildpack string `json:"buildpack,omitempty"`
+}
+
+// GetDepsInfo reads the config.yml each buildpack wrote into its deps dir,
+// keyed by deps index
+func (c *MultiCompiler) GetDepsInfo(depsDir string) (map[string]DepsInfo, error) {
+	dirs, err := ioutil.ReadDir(depsDir)
+	if err != nil {
+		return nil, err
+	}
+
+	info := map[string]DepsInfo{}
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+
+		idx, err := strconv.Atoi(dir.Name())
+		if err != nil {
+			continue
+		}
+
+		entry := DepsInfo{}
+		if idx < len(c.Buildpacks) {
+			entry.Buildpack = c.Buildpacks[idx]
+		}
+
+		configYml := struct {
+			Name    string `yaml:"name"`
+			Version string `yaml:"version"`
+		}{}
+		if err := libbuildpack.NewYAML().Load(filepath.Join(depsDir, dir.Name(), "config.yml"), &configYml); err == nil {
+			entry.Name = configYml.Name
+			entry.Version = configYml.Version
+		} else if !os.IsNotExist(err) {
+			c.Log.Warning("Unable to read %s: %s", filepath.Join(depsDir, dir.Name(), "config.yml"), err.Error())
+		}
+
+		info[dir.Name()] = entry
+	}
+
+	return info, nil
+}
+
+// WriteDepsInfo writes .multi-buildpack/deps.json, mapping each deps index to
+// the buildpack that supplied it, and a .profile.d script exporting a
+// DEPS_<NAME>_DIR variable for each named buildpack
+func (c *MultiCompiler) WriteDepsInfo() error {
+	info, err := c.GetDepsInfo(filepath.Join(c.BuildDir, ".deps"))
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Join(c.BuildDir, ".multi-buildpack"), 0755); err != nil {
+		return err
+	}
+	if err := libbuildpack.NewJSON().Write(filepath.Join(c.BuildDir, ".multi-buildpack", "deps.json"), info); err != nil {
+		return err
+	}
+
+	indexes := []string{}
+	for idx := range info {
+		indexes = append(indexes, idx)
+	}
+	sort.Strings(indexes)
+
+	script := ""
+	exported := map[string]string{}
+	for _, idx := range indexes {
+		name := info[idx].Name
+		if name == "" {
+			continue
+		}
+
+		envVar := DepsDirEnvVar(name)
+		if other, found := exported[envVar]; found {
+			c.Log.Warning("Both deps %s and %s were supplied by %s; %s points at %s", other, idx, name, envVar, other)
+			continue
+		}
+		exported[envVar] = idx
+
+		script += fmt.Sprintf("export %s=\"$DEPS_DIR/%s\"\n", envVar, idx)
+	}
+
+	profileDir := filepath.Join(c.BuildDir, ".profile.d")
+	if err := os.MkdirAll(profileDir, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(profileDir, DepsProfileScriptName), []byte(script), 0755)
+}
+
+// DepsDirEnvVar returns the env var holding the deps dir of a buildpack,
+// e.g. DEPS_PYTHON_DIR
+func DepsDirEnvVar(name string) string {
+	return "DEPS_" + strings.Trim(invalidEnvVarChars.ReplaceAllString(strings.ToUpper(name), "_"), "_") + "_DIR"
+}
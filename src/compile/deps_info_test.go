@@ -0,0 +1,111 @@
+package main_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	c "compile"
+
+	"github.com/cloudfoundry/libbuildpack"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("WriteDepsInfo", func() {
+	var (
+		err      error
+		buildDir string
+		depsDir  string
+		compiler *c.MultiCompiler
+		buffer   *bytes.Buffer
+	)
+
+	writeConfig := func(idx, contents string) {
+		Expect(os.MkdirAll(filepath.Join(depsDir, idx), 0755)).To(Succeed())
+		if contents != "" {
+			Expect(ioutil.WriteFile(filepath.Join(depsDir, idx, "config.yml"), []byte(contents), 0644)).To(Succeed())
+		}
+	}
+
+	BeforeEach(func() {
+		buildDir, err = ioutil.TempDir("", "build")
+		Expect(err).To(BeNil())
+		depsDir = filepath.Join(buildDir, ".deps")
+
+		buffer = new(bytes.Buffer)
+		compiler = &c.MultiCompiler{
+			BuildDir: buildDir,
+			Log:      libbuildpack.NewLogger(buffer),
+			Buildpacks: []string{
+				"https://github.com/cloudfoundry/python-buildpack#v1.6.11",
+				"https://github.com/cloudfoundry/nodejs-buildpack#v1.6.20",
+				"https://example.com/custom-buildpack",
+				"https://github.com/cloudfoundry/go-buildpack",
+			},
+		}
+
+		writeConfig("0", "name: python\nversion: 1.6.11\nconfig: {}\n")
+		writeConfig("1", "name: nodejs\nversion: 1.6.20\n")
+		writeConfig("2", "")
+		writeConfig("3", "name: go\nversion: 1.8.18\n")
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(buildDir)).To(Succeed())
+	})
+
+	It("maps each deps index to the buildpack that supplied it", func() {
+		Expect(compiler.WriteDepsInfo()).To(Succeed())
+
+		Expect(ioutil.ReadFile(filepath.Join(buildDir, ".multi-buildpack", "deps.json"))).To(MatchJSON(`{
+			"0": {"name": "python", "version": "1.6.11", "buildpack": "https://github.com/cloudfoundry/python-buildpack#v1.6.11"},
+			"1": {"name": "nodejs", "version": "1.6.20", "buildpack": "https://github.com/cloudfoundry/nodejs-buildpack#v1.6.20"},
+			"2": {"name": "", "buildpack": "https://example.com/custom-buildpack"},
+			"3": {"name": "go", "version": "1.8.18", "buildpack": "https://github.com/cloudfoundry/go-buildpack"}
+		}`))
+	})
+
+	It("exports a DEPS_<NAME>_DIR variable for each named buildpack", func() {
+		Expect(compiler.WriteDepsInfo()).To(Succeed())
+
+		cmd := exec.Command("bash", "-c", `source .profile.d/`+c.DepsProfileScriptName+` && echo "$DEPS_PYTHON_DIR $DEPS_NODEJS_DIR $DEPS_GO_DIR"`)
+		cmd.Dir = buildDir
+		cmd.Env = append(os.Environ(), "DEPS_DIR=/home/vcap/deps")
+		output, err := cmd.Output()
+		Expect(err).To(BeNil())
+		Expect(strings.TrimSpace(string(output))).To(Equal("/home/vcap/deps/0 /home/vcap/deps/1 /home/vcap/deps/3"))
+	})
+
+	It("runs after DEPS_DIR is set and before the buildpack scripts", func() {
+		scripts := []string{"00000001_2_ruby.sh", c.DepsProfileScriptName, c.MultiProfileScriptName}
+		sort.Strings(scripts)
+		Expect(scripts).To(Equal([]string{c.MultiProfileScriptName, c.DepsProfileScriptName, "00000001_2_ruby.sh"}))
+	})
+
+	Context("two deps dirs have the same name", func() {
+		BeforeEach(func() {
+			writeConfig("2", "name: python\n")
+		})
+
+		It("points the variable at the first one and warns", func() {
+			Expect(compiler.WriteDepsInfo()).To(Succeed())
+
+			Expect(ioutil.ReadFile(filepath.Join(buildDir, ".profile.d", c.DepsProfileScriptName))).To(Equal([]byte(
+				"export DEPS_PYTHON_DIR=\"$DEPS_DIR/0\"\nexport DEPS_NODEJS_DIR=\"$DEPS_DIR/1\"\nexport DEPS_GO_DIR=\"$DEPS_DIR/3\"\n",
+			)))
+			Expect(buffer.String()).To(ContainSubstring("Both deps 0 and 2 were supplied by python"))
+		})
+	})
+
+	Describe("DepsDirEnvVar", func() {
+		It("builds a valid env var name", func() {
+			Expect(c.DepsDirEnvVar("python")).To(Equal("DEPS_PYTHON_DIR"))
+			Expect(c.DepsDirEnvVar("dotnet-core")).To(Equal("DEPS_DOTNET_CORE_DIR"))
+		})
+	})
+})
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/cloudfoundry/libbuildpack"
+)
+
+var buildpackVersionSuffix = regexp.MustCompile(`[-_.](cached[-_.])?v?[0-9]+(\.[0-9]+)*$`)
+
+// Detect passes when buildDir has a valid multi-buildpack.yml, .buildpacks
+// or manifest.yml listing buildpacks, and prints the buildpack version and
+// the buildpacks it will run
+func Detect(buildDir string, out io.Writer, logger *libbuildpack.Logger) error {
+	found := false
+	for _, file := range []string{"multi-buildpack.yml", ".buildpacks"} {
+		exists, err := libbuildpack.FileExists(filepath.Join(buildDir, file))
+		if err != nil {
+			return err
+		}
+		found = found || exists
+	}
+	if !found {
+		if _, found = GetAppManifestBuildpacks(buildDir); !found {
+			return errors.New("no multi-buildpack.yml, .buildpacks or manifest.yml buildpacks list exists")
+		}
+	}
+
+	metadata, err := GetMultiBuildpackMetadata(buildDir, logger)
+	if err != nil {
+		return err
+	}
+
+	buildpackDir, err := libbuildpack.GetBuildpackDir()
+	if err != nil {
+		return err
+	}
+	version, err := ioutil.ReadFile(filepath.Join(buildpackDir, "VERSION"))
+	if err != nil {
+		return err
+	}
+
+	names := []string{}
+	for _, buildpack := range metadata.Buildpacks {
+		names = append(names, BuildpackName(buildpack))
+	}
+	if len(metadata.FinalCandidates) > 0 {
+		candidates := []string{}
+		for _, candidate := range metadata.FinalCandidates {
+			candidates = append(candidates, BuildpackName(candidate))
+		}
+		names = append(names, strings.Join(candidates, "|"))
+	}
+
+	_, err = fmt.Fprintf(out, "multi-buildpack %s (%s)\n", strings.TrimSpace(string(version)), strings.Join(names, ", "))
+	return err
+}
+
+// BuildpackName guesses a short name for a buildpack from its URL, e.g. ruby
+// for https://github.com/cloudfoundry/ruby-buildpack#v1.7.2
+func BuildpackName(buildpack string) string {
+	name := buildpack
+	if u, err := url.Parse(buildpack); err == nil && u.Path != "" {
+		name = u.Path
+	}
+
+	name = path.Base(strings.TrimSuffix(name, "/"))
+	name = strings.TrimSuffix(name, ".git")
+	name = strings.TrimSuffix(name, ".zip")
+	name = buildpackVersionSuffix.ReplaceAllString(name, "")
+	name = strings.TrimSuffix(strings.TrimSuffix(name, "-buildpack"), "_buildpack")
+
+	if name == "" || name == "." || name == "/" {
+		return buildpack
+	}
+	return name
+}
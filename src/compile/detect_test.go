@@ -0,0 +1,147 @@
+package main_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	c "compile"
+
+	"github.com/cloudfoundry/libbuildpack"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Detect", func() {
+	var (
+		err          error
+		buildDir     string
+		buildpackDir string
+		output       *bytes.Buffer
+		buffer       *bytes.Buffer
+		logger       *libbuildpack.Logger
+	)
+
+	BeforeEach(func() {
+		buildDir, err = ioutil.TempDir("", "build")
+		Expect(err).To(BeNil())
+
+		buildpackDir, err = ioutil.TempDir("", "buildpack")
+		Expect(err).To(BeNil())
+		Expect(ioutil.WriteFile(filepath.Join(buildpackDir, "VERSION"), []byte("1.0.3\n"), 0644)).To(Succeed())
+		os.Setenv("BUILDPACK_DIR", buildpackDir)
+
+		output = new(bytes.Buffer)
+		buffer = new(bytes.Buffer)
+		logger = libbuildpack.NewLogger(buffer)
+	})
+
+	AfterEach(func() {
+		os.Unsetenv("BUILDPACK_DIR")
+		Expect(os.RemoveAll(buildDir)).To(Succeed())
+		Expect(os.RemoveAll(buildpackDir)).To(Succeed())
+	})
+
+	Context("multi-buildpack.yml is valid", func() {
+		BeforeEach(func() {
+			content := "buildpacks:\n- https://github.com/cloudfoundry/nodejs-buildpack#v1.5.18\n- https://github.com/cloudfoundry/ruby-buildpack/releases/download/v1.6.23/ruby_buildpack-cached-v1.6.23.zip\n"
+			Expect(ioutil.WriteFile(filepath.Join(buildDir, "multi-buildpack.yml"), []byte(content), 0644)).To(Succeed())
+		})
+
+		It("prints the version and the buildpacks", func() {
+			Expect(c.Detect(buildDir, output, logger)).To(Succeed())
+			Expect(output.String()).To(Equal("multi-buildpack 1.0.3 (nodejs, ruby)\n"))
+		})
+	})
+
+	Context("multi-buildpack.yml has final_candidates", func() {
+		BeforeEach(func() {
+			content := "buildpacks:\n- https://github.com/cloudfoundry/nodejs-buildpack\nfinal_candidates:\n- https://github.com/cloudfoundry/ruby-buildpack\n- https://github.com/cloudfoundry/go-buildpack\n"
+			Expect(ioutil.WriteFile(filepath.Join(buildDir, "multi-buildpack.yml"), []byte(content), 0644)).To(Succeed())
+		})
+
+		It("prints the candidates as the final buildpack", func() {
+			Expect(c.Detect(buildDir, output, logger)).To(Succeed())
+			Expect(output.String()).To(Equal("multi-buildpack 1.0.3 (nodejs, ruby|go)\n"))
+		})
+	})
+
+	Context("multi-buildpack.yml is malformed", func() {
+		BeforeEach(func() {
+			Expect(ioutil.WriteFile(filepath.Join(buildDir, "multi-buildpack.yml"), []byte("buildpacks: []\n"), 0644)).To(Succeed())
+		})
+
+		It("fails and informs the user", func() {
+			Expect(c.Detect(buildDir, output, logger)).NotTo(Succeed())
+			Expect(output.String()).To(Equal(""))
+			Expect(buffer.String()).To(ContainSubstring("The multi-buildpack.yml file is malformed: no buildpacks are listed"))
+		})
+	})
+
+	Context("a .buildpacks file lists buildpacks", func() {
+		BeforeEach(func() {
+			content := "https://github.com/heroku/heroku-buildpack-nodejs#v121\nhttps://github.com/heroku/heroku-buildpack-ruby\n"
+			Expect(ioutil.WriteFile(filepath.Join(buildDir, ".buildpacks"), []byte(content), 0644)).To(Succeed())
+		})
+
+		It("passes", func() {
+			Expect(c.Detect(buildDir, output, logger)).To(Succeed())
+			Expect(output.String()).To(Equal("multi-buildpack 1.0.3 (heroku-buildpack-nodejs, heroku-buildpack-ruby)\n"))
+		})
+	})
+
+	Context("manifest.yml lists buildpacks", func() {
+		BeforeEach(func() {
+			content := "applications:\n- name: my-app\n  buildpacks:\n  - https://github.com/cloudfoundry/go-buildpack\n"
+			Expect(ioutil.WriteFile(filepath.Join(buildDir, "manifest.yml"), []byte(content), 0644)).To(Succeed())
+		})
+
+		It("passes", func() {
+			Expect(c.Detect(buildDir, output, logger)).To(Succeed())
+			Expect(output.String()).To(Equal("multi-buildpack 1.0.3 (go)\n"))
+		})
+	})
+
+	Context("manifest.yml lists system buildpacks", func() {
+		BeforeEach(func() {
+			content := "applications:\n- name: my-app\n  buildpacks:\n  - go_buildpack\n"
+			Expect(ioutil.WriteFile(filepath.Join(buildDir, "manifest.yml"), []byte(content), 0644)).To(Succeed())
+		})
+
+		It("fails and informs the user", func() {
+			Expect(c.Detect(buildDir, output, logger)).NotTo(Succeed())
+			Expect(output.String()).To(Equal(""))
+			Expect(buffer.String()).To(ContainSubstring("go_buildpack is not a buildpack URL"))
+		})
+	})
+
+	Context("manifest.yml does not list buildpacks", func() {
+		BeforeEach(func() {
+			Expect(ioutil.WriteFile(filepath.Join(buildDir, "manifest.yml"), []byte("applications:\n- name: my-app\n"), 0644)).To(Succeed())
+		})
+
+		It("fails quietly", func() {
+			Expect(c.Detect(buildDir, output, logger)).NotTo(Succeed())
+			Expect(buffer.String()).To(Equal(""))
+		})
+	})
+
+	Context("multi-buildpack.yml does not exist", func() {
+		It("fails quietly", func() {
+			Expect(c.Detect(buildDir, output, logger)).NotTo(Succeed())
+			Expect(output.String()).To(Equal(""))
+			Expect(buffer.String()).To(Equal(""))
+		})
+	})
+
+	Describe("BuildpackName", func() {
+		It("names the buildpack after its URL", func() {
+			Expect(c.BuildpackName("https://github.com/cloudfoundry/go-buildpack")).To(Equal("go"))
+			Expect(c.BuildpackName("https://github.com/cloudfoundry/python-buildpack#develop")).To(Equal("python"))
+			Expect(c.BuildpackName("https://github.com/cloudfoundry/php-buildpack.git")).To(Equal("php"))
+			Expect(c.BuildpackName("https://example.com/buildpacks/dotnet-core_buildpack-v1.0.31.zip")).To(Equal("dotnet-core"))
+			Expect(c.BuildpackName("https://example.com/custom")).To(Equal("custom"))
+		})
+	})
+})
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/cloudfoundry/libbuildpack"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Migrate prints the app's manifest.yml with the buildpacks and env from its
+// multi-buildpack.yml, for native multi-buildpack support. It returns the
+// parts of multi-buildpack.yml that the manifest cannot express, which need
+// to be reviewed by hand.
+func Migrate(appDir, manifestFile string, out io.Writer, logger *libbuildpack.Logger) ([]string, error) {
+	metadata, err := GetMultiBuildpackMetadata(appDir, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(manifestFile)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := yaml.MapSlice{}
+	if err := yaml.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("%s is malformed: %s", manifestFile, err.Error())
+	}
+
+	manifest, issues, err := MigrateManifest(metadata, manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err = yaml.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	_, err = out.Write(data)
+	return issues, err
+}
+
+// MigrateManifest sets the buildpacks and env of every application in a CF
+// app manifest from multi-buildpack.yml
+func MigrateManifest(metadata *MultiBuildpackMetadata, manifest yaml.MapSlice) (yaml.MapSlice, []string, error) {
+	issues := []string{}
+
+	buildpacks := []string{}
+	for _, buildpack := range metadata.Buildpacks {
+		buildpacks = append(buildpacks, buildpack)
+
+		u, err := url.Parse(buildpack)
+		if err != nil || u.Fragment == "" {
+			continue
+		}
+		if isChecksum(u.Fragment) {
+			issues = append(issues, fmt.Sprintf("buildpack %s has a checksum, which cf push does not verify", buildpack))
+		} else {
+			issues = append(issues, fmt.Sprintf("buildpack %s has a git fragment (#%s), which not every Cloud Foundry supports", buildpack, u.Fragment))
+		}
+	}
+
+	for _, entry := range metadata.Entries {
+		if entry.BuildOnly {
+			issues = append(issues, fmt.Sprintf("buildpack %s is build_only, which the manifest cannot express; its deps will stay in the droplet", entry.URL))
+		}
+		if entry.When != nil {
+			issues = append(issues, fmt.Sprintf("buildpack %s has a when condition, which the manifest cannot express; it will always run", entry.URL))
+		}
+		if entry.Optional {
+			issues = append(issues, fmt.Sprintf("buildpack %s is optional, which the manifest cannot express; its failures will fail staging", entry.URL))
+		}
+	}
+
+	if metadata.Cache != (CacheMetadata{}) {
+		issues = append(issues, "cache has no equivalent in the manifest; the platform keeps one build cache per buildpack")
+	}
+	if metadata.StartFrom != "" {
+		issues = append(issues, fmt.Sprintf("start_from %s has no equivalent in the manifest; set command instead", metadata.StartFrom))
+	}
+	for _, decorator := range metadata.Decorators {
+		issues = append(issues, fmt.Sprintf("decorator %s has no equivalent in the manifest", decorator))
+	}
+	if len(metadata.FinalCandidates) > 0 {
+		issues = append(issues, fmt.Sprintf("final_candidates has no equivalent in the manifest; add one of %s to buildpacks", strings.Join(metadata.FinalCandidates, ", ")))
+	}
+	if metadata.Auto {
+		issues = append(issues, "auto has no equivalent in the manifest; every buildpack will run")
+	}
+	if metadata.MergeConfigVars {
+		issues = append(issues, "merge_config_vars has no equivalent in the manifest")
+	}
+	for _, name := range sortedKeys(metadata.Processes) {
+		if name != "web" {
+			issues = append(issues, fmt.Sprintf("process %s has no equivalent in the manifest; add it to your Procfile", name))
+		}
+	}
+
+	applications, found := mapSliceGet(manifest, "applications")
+	if !found {
+		return nil, nil, errors.New("the manifest has no applications")
+	}
+	apps, ok := applications.([]interface{})
+	if !ok || len(apps) == 0 {
+		return nil, nil, errors.New("the manifest has no applications")
+	}
+
+	for i, app := range apps {
+		application, ok := app.(yaml.MapSlice)
+		if !ok {
+			return nil, nil, fmt.Errorf("application %d in the manifest is malformed", i)
+		}
+		name, _ := mapSliceGet(application, "name")
+
+		if buildpack, found := mapSliceGet(application, "buildpack"); found {
+			issues = append(issues, fmt.Sprintf("replaced buildpack %v of application %v with buildpacks", buildpack, name))
+			application = mapSliceDelete(application, "buildpack")
+		}
+		application = mapSliceSet(application, "buildpacks", buildpacks)
+
+		if command, found := metadata.Processes["web"]; found {
+			if existing, found := mapSliceGet(application, "command"); found && existing != command {
+				issues = append(issues, fmt.Sprintf("kept command %v of application %v rather than the web process %s", existing, name, command))
+			} else {
+				application = mapSliceSet(application, "command", command)
+			}
+		}
+
+		if len(metadata.Env) > 0 {
+			existing, _ := mapSliceGet(application, "env")
+			env, ok := existing.(yaml.MapSlice)
+			if existing != nil && !ok {
+				return nil, nil, fmt.Errorf("the env of application %v in the manifest is malformed", name)
+			}
+			for _, key := range sortedKeys(metadata.Env) {
+				if value, found := mapSliceGet(env, key); found {
+					if fmt.Sprint(value) != metadata.Env[key] {
+						issues = append(issues, fmt.Sprintf("kept env %s of application %v rather than the value in multi-buildpack.yml", key, name))
+					}
+					continue
+				}
+				env = mapSliceSet(env, key, metadata.Env[key])
+			}
+			application = mapSliceSet(application, "env", env)
+		}
+
+		apps[i] = application
+	}
+
+	return mapSliceSet(manifest, "applications", apps), issues, nil
+}
+
+// DefaultManifestFile is the app manifest Migrate updates when none is given
+func DefaultManifestFile(appDir string) string {
+	return filepath.Join(appDir, "manifest.yml")
+}
+
+func isChecksum(fragment string) bool {
+	for _, algorithm := range []string{"md5", "sha1", "sha256", "sha512"} {
+		if strings.HasPrefix(fragment, algorithm+"=") || strings.HasPrefix(fragment, algorithm+":") {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := []string{}
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func mapSliceGet(m yaml.MapSlice, key string) (interface{}, bool) {
+	for _, item := range m {
+		if item.Key == key {
+			return item.Value, true
+		}
+	}
+	return nil, false
+}
+
+func mapSliceSet(m yaml.MapSlice, key string, value interface{}) yaml.MapSlice {
+	for i, item := range m {
+		if item.Key == key {
+			m[i].Value = value
+			return m
+		}
+	}
+	return append(m, yaml.MapItem{Key: key, Value: value})
+}
+
+func mapSliceDelete(m yaml.MapSlice, key string) yaml.MapSlice {
+	result := yaml.MapSlice{}
+	for _, item := range m {
+		if item.Key != key {
+			result = append(result, item)
+		}
+	}
+	return result
+}
@@ -0,0 +1,143 @@
+package main_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	c "compile"
+
+	"github.com/cloudfoundry/libbuildpack"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Migrate", func() {
+	var (
+		err          error
+		appDir       string
+		manifestFile string
+		output       *bytes.Buffer
+		logger       *libbuildpack.Logger
+		issues       []string
+	)
+
+	BeforeEach(func() {
+		appDir, err = ioutil.TempDir("", "app")
+		Expect(err).To(BeNil())
+		manifestFile = c.DefaultManifestFile(appDir)
+
+		output = new(bytes.Buffer)
+		logger = libbuildpack.NewLogger(new(bytes.Buffer))
+
+		Expect(ioutil.WriteFile(manifestFile, []byte(`---
+applications:
+- name: my-app
+  memory: 256M
+  buildpack: https://github.com/cloudfoundry/multi-buildpack
+  env:
+    RAILS_ENV: production
+`), 0644)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(appDir)).To(Succeed())
+	})
+
+	JustBeforeEach(func() {
+		issues, err = c.Migrate(appDir, manifestFile, output, logger)
+	})
+
+	Context("multi-buildpack.yml can be expressed natively", func() {
+		BeforeEach(func() {
+			Expect(ioutil.WriteFile(filepath.Join(appDir, "multi-buildpack.yml"), []byte(`buildpacks:
+- https://github.com/cloudfoundry/nodejs-buildpack
+- https://github.com/cloudfoundry/ruby-buildpack
+env:
+  NODE_ENV: production
+processes:
+  web: bundle exec puma
+`), 0644)).To(Succeed())
+		})
+
+		It("replaces the buildpack and adds the env, keeping the rest of the manifest", func() {
+			Expect(err).To(BeNil())
+			Expect(output.String()).To(Equal(`applications:
+- name: my-app
+  memory: 256M
+  env:
+    RAILS_ENV: production
+    NODE_ENV: production
+  buildpacks:
+  - https://github.com/cloudfoundry/nodejs-buildpack
+  - https://github.com/cloudfoundry/ruby-buildpack
+  command: bundle exec puma
+`))
+		})
+
+		It("only flags the replaced buildpack", func() {
+			Expect(issues).To(Equal([]string{"replaced buildpack https://github.com/cloudfoundry/multi-buildpack of application my-app with buildpacks"}))
+		})
+	})
+
+	Context("multi-buildpack.yml has options the manifest cannot express", func() {
+		BeforeEach(func() {
+			Expect(ioutil.WriteFile(filepath.Join(appDir, "multi-buildpack.yml"), []byte(`buildpacks:
+- url: https://github.com/cloudfoundry/python-buildpack
+  build_only: true
+  optional: true
+  when:
+    service_tag: python
+- https://github.com/cloudfoundry/nodejs-buildpack#v1.6.20
+- https://example.com/ruby_buildpack-v1.7.2.zip#sha256=abc123
+cache:
+  limit: 512M
+start_from: nodejs
+auto: true
+final_candidates:
+- https://github.com/cloudfoundry/go-buildpack
+decorators:
+- https://example.com/apm-decorator
+processes:
+  worker: bundle exec sidekiq
+env:
+  RAILS_ENV: development
+`), 0644)).To(Succeed())
+		})
+
+		It("flags them", func() {
+			Expect(err).To(BeNil())
+			Expect(issues).To(ContainElement("buildpack https://github.com/cloudfoundry/nodejs-buildpack#v1.6.20 has a git fragment (#v1.6.20), which not every Cloud Foundry supports"))
+			Expect(issues).To(ContainElement("buildpack https://example.com/ruby_buildpack-v1.7.2.zip#sha256=abc123 has a checksum, which cf push does not verify"))
+			Expect(issues).To(ContainElement("buildpack https://github.com/cloudfoundry/python-buildpack is build_only, which the manifest cannot express; its deps will stay in the droplet"))
+			Expect(issues).To(ContainElement("buildpack https://github.com/cloudfoundry/python-buildpack is optional, which the manifest cannot express; its failures will fail staging"))
+			Expect(issues).To(ContainElement("buildpack https://github.com/cloudfoundry/python-buildpack has a when condition, which the manifest cannot express; it will always run"))
+			Expect(issues).To(ContainElement("cache has no equivalent in the manifest; the platform keeps one build cache per buildpack"))
+			Expect(issues).To(ContainElement("start_from nodejs has no equivalent in the manifest; set command instead"))
+			Expect(issues).To(ContainElement("decorator https://example.com/apm-decorator has no equivalent in the manifest"))
+			Expect(issues).To(ContainElement("auto has no equivalent in the manifest; every buildpack will run"))
+			Expect(issues).To(ContainElement("final_candidates has no equivalent in the manifest; add one of https://github.com/cloudfoundry/go-buildpack to buildpacks"))
+			Expect(issues).To(ContainElement("process worker has no equivalent in the manifest; add it to your Procfile"))
+			Expect(issues).To(ContainElement("kept env RAILS_ENV of application my-app rather than the value in multi-buildpack.yml"))
+		})
+
+		It("keeps the buildpack entries as they are", func() {
+			Expect(output.String()).To(ContainSubstring("  - https://github.com/cloudfoundry/python-buildpack\n  - https://github.com/cloudfoundry/nodejs-buildpack#v1.6.20\n  - https://example.com/ruby_buildpack-v1.7.2.zip#sha256=abc123\n"))
+			Expect(output.String()).To(ContainSubstring("RAILS_ENV: production"))
+		})
+	})
+
+	Context("the manifest has no applications", func() {
+		BeforeEach(func() {
+			Expect(ioutil.WriteFile(filepath.Join(appDir, "multi-buildpack.yml"), []byte("buildpacks:\n- https://github.com/cloudfoundry/go-buildpack\n"), 0644)).To(Succeed())
+			Expect(ioutil.WriteFile(manifestFile, []byte("---\ninherit: base.yml\n"), 0644)).To(Succeed())
+		})
+
+		It("returns an error", func() {
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(Equal("the manifest has no applications"))
+			Expect(output.String()).To(Equal(""))
+		})
+	})
+})
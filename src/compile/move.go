@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"code.cloudfoundry.org/bytefmt"
+	"github.com/cloudfoundry/libbuildpack"
+	"golang.org/x/sys/unix"
+)
+
+// LargeTreeSize is the size from which trees get progress reported while
+// they are copied
+var LargeTreeSize uint64 = 100 * bytefmt.MEGABYTE
+
+// MovePath renames src to dest, falling back to copying and deleting src when
+// they are on different filesystems
+func MovePath(src, dest string, logger *libbuildpack.Logger) error {
+	err := os.Rename(src, dest)
+	if err == nil || !isCrossDevice(err) {
+		return err
+	}
+
+	logger.Debug("%s and %s are on different filesystems, copying instead", src, dest)
+
+	// like a rename, never merge into or replace what is already there
+	if _, err := os.Lstat(dest); err == nil {
+		return fmt.Errorf("unable to move %s to %s: the destination already exists", src, dest)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := CopyTree(src, dest, logger); err != nil {
+		os.RemoveAll(dest)
+		return err
+	}
+
+	return os.RemoveAll(src)
+}
+
+func isCrossDevice(err error) bool {
+	if linkErr, ok := err.(*os.LinkError); ok {
+		return linkErr.Err == syscall.EXDEV
+	}
+	return false
+}
+
+type inode struct {
+	dev uint64
+	ino uint64
+}
+
+type treeCopier struct {
+	logger    *libbuildpack.Logger
+	total     uint64
+	copied    uint64
+	reported  uint64
+	hardlinks map[inode]string
+	dirs      []string
+	dirInfos  []os.FileInfo
+}
+
+// CopyTree recursively copies src to dest, preserving permissions, symlinks,
+// hardlinks and timestamps
+func CopyTree(src, dest string, logger *libbuildpack.Logger) error {
+	tc := &treeCopier{
+		logger:    logger,
+		hardlinks: map[inode]string{},
+	}
+
+	// hardlinked files are only copied once, so only counted once
+	counted := map[inode]bool{}
+	if err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && stat.Nlink > 1 {
+			key := inode{dev: uint64(stat.Dev), ino: uint64(stat.Ino)}
+			if counted[key] {
+				return nil
+			}
+			counted[key] = true
+		}
+		tc.total += uint64(info.Size())
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if tc.total >= LargeTreeSize {
+		logger.Info("Copying %s from %s to %s", bytefmt.ByteSize(tc.total), src, dest)
+	}
+
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		return tc.copyEntry(path, filepath.Join(dest, rel), info)
+	})
+	if err != nil {
+		return err
+	}
+
+	// directories stay writable and their timestamps change while their
+	// contents are copied, so both are restored last, deepest first
+	for i := len(tc.dirs) - 1; i >= 0; i-- {
+		if err := os.Chmod(tc.dirs[i], preservedMode(tc.dirInfos[i])); err != nil {
+			return err
+		}
+		if err := setTimes(tc.dirs[i], tc.dirInfos[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (tc *treeCopier) copyEntry(src, dest string, info os.FileInfo) error {
+	switch {
+	case info.IsDir():
+		if err := os.Mkdir(dest, 0700); err != nil {
+			return err
+		}
+		tc.dirs = append(tc.dirs, dest)
+		tc.dirInfos = append(tc.dirInfos, info)
+		return nil
+
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(target, dest); err != nil {
+			return err
+		}
+		return setTimes(dest, info)
+
+	case info.Mode().IsRegular():
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && stat.Nlink > 1 {
+			key := inode{dev: uint64(stat.Dev), ino: uint64(stat.Ino)}
+			if first, found := tc.hardlinks[key]; found {
+				return os.Link(first, dest)
+			}
+			tc.hardlinks[key] = dest
+		}
+		if err := tc.copyFile(src, dest, info); err != nil {
+			return err
+		}
+		return setTimes(dest, info)
+
+	default:
+		return fmt.Errorf("unable to copy %s: unsupported file type %s", src, info.Mode().String())
+	}
+}
+
+func (tc *treeCopier) copyFile(src, dest string, info os.FileInfo) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(dest, preservedMode(info)); err != nil {
+		return err
+	}
+
+	tc.copied += uint64(info.Size())
+	tc.reportProgress()
+	return nil
+}
+
+func (tc *treeCopier) reportProgress() {
+	if tc.total < LargeTreeSize {
+		return
+	}
+
+	percent := tc.copied * 100 / tc.total
+	if percent/10 > tc.reported/10 {
+		tc.reported = percent
+		tc.logger.Info("Copied %s of %s (%d%%)", bytefmt.ByteSize(tc.copied), bytefmt.ByteSize(tc.total), percent)
+	}
+}
+
+func preservedMode(info os.FileInfo) os.FileMode {
+	return info.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+}
+
+func setTimes(path string, info os.FileInfo) error {
+	atime := info.ModTime()
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		atime = time.Unix(int64(stat.Atim.Sec), int64(stat.Atim.Nsec))
+	}
+
+	ts := []unix.Timespec{
+		unix.NsecToTimespec(atime.UnixNano()),
+		unix.NsecToTimespec(info.ModTime().UnixNano()),
+	}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, path, ts, unix.AT_SYMLINK_NOFOLLOW)
+}
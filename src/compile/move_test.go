@@ -0,0 +1,187 @@
+package main_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	c "compile"
+
+	"github.com/cloudfoundry/libbuildpack"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Move", func() {
+	var (
+		err     error
+		srcDir  string
+		destDir string
+		buffer  *bytes.Buffer
+		logger  *libbuildpack.Logger
+		mtime   time.Time
+	)
+
+	BeforeEach(func() {
+		srcDir, err = ioutil.TempDir("", "src")
+		Expect(err).To(BeNil())
+
+		destDir, err = ioutil.TempDir("", "dest")
+		Expect(err).To(BeNil())
+
+		buffer = new(bytes.Buffer)
+		logger = libbuildpack.NewLogger(buffer)
+
+		mtime = time.Date(2017, 10, 31, 12, 0, 0, 0, time.UTC)
+
+		Expect(os.MkdirAll(filepath.Join(srcDir, "deps", "0", "bin"), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(srcDir, "deps", "0", "bin", "ruby"), []byte("ruby"), 0750)).To(Succeed())
+		Expect(os.Link(filepath.Join(srcDir, "deps", "0", "bin", "ruby"), filepath.Join(srcDir, "deps", "0", "bin", "ruby2"))).To(Succeed())
+		Expect(os.Symlink("bin/ruby", filepath.Join(srcDir, "deps", "0", "ruby"))).To(Succeed())
+		Expect(os.Chtimes(filepath.Join(srcDir, "deps", "0", "bin", "ruby"), mtime, mtime)).To(Succeed())
+		Expect(os.Chtimes(filepath.Join(srcDir, "deps", "0", "bin"), mtime, mtime)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(srcDir)).To(Succeed())
+		Expect(os.RemoveAll(destDir)).To(Succeed())
+	})
+
+	Describe("CopyTree", func() {
+		var depsDir string
+
+		JustBeforeEach(func() {
+			depsDir = filepath.Join(destDir, "deps")
+			Expect(c.CopyTree(filepath.Join(srcDir, "deps"), depsDir, logger)).To(Succeed())
+		})
+
+		It("copies the file contents and permissions", func() {
+			Expect(ioutil.ReadFile(filepath.Join(depsDir, "0", "bin", "ruby"))).To(Equal([]byte("ruby")))
+
+			info, err := os.Stat(filepath.Join(depsDir, "0", "bin", "ruby"))
+			Expect(err).To(BeNil())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0750)))
+		})
+
+		It("preserves symlinks", func() {
+			target, err := os.Readlink(filepath.Join(depsDir, "0", "ruby"))
+			Expect(err).To(BeNil())
+			Expect(target).To(Equal("bin/ruby"))
+		})
+
+		It("preserves hardlinks", func() {
+			first, err := os.Stat(filepath.Join(depsDir, "0", "bin", "ruby"))
+			Expect(err).To(BeNil())
+			second, err := os.Stat(filepath.Join(depsDir, "0", "bin", "ruby2"))
+			Expect(err).To(BeNil())
+
+			Expect(os.SameFile(first, second)).To(BeTrue())
+			Expect(first.Sys().(*syscall.Stat_t).Nlink).To(BeEquivalentTo(2))
+		})
+
+		It("preserves file and directory timestamps", func() {
+			info, err := os.Stat(filepath.Join(depsDir, "0", "bin", "ruby"))
+			Expect(err).To(BeNil())
+			Expect(info.ModTime().Equal(mtime)).To(BeTrue())
+
+			info, err = os.Stat(filepath.Join(depsDir, "0", "bin"))
+			Expect(err).To(BeNil())
+			Expect(info.ModTime().Equal(mtime)).To(BeTrue())
+		})
+
+		It("does not report progress for small trees", func() {
+			Expect(buffer.String()).To(Equal(""))
+		})
+
+		Context("the tree is large", func() {
+			var largeTreeSize uint64
+
+			BeforeEach(func() {
+				largeTreeSize = c.LargeTreeSize
+				c.LargeTreeSize = 1
+				Expect(ioutil.WriteFile(filepath.Join(srcDir, "deps", "0", "gem"), []byte("gems"), 0644)).To(Succeed())
+			})
+
+			AfterEach(func() {
+				c.LargeTreeSize = largeTreeSize
+			})
+
+			It("reports the progress, counting hardlinked files once", func() {
+				Expect(buffer.String()).To(ContainSubstring("Copying 8B from " + filepath.Join(srcDir, "deps") + " to " + depsDir))
+				Expect(buffer.String()).To(ContainSubstring("Copied 4B of 8B (50%)"))
+				Expect(buffer.String()).To(ContainSubstring("Copied 8B of 8B (100%)"))
+			})
+		})
+	})
+
+	Describe("MovePath", func() {
+		It("moves the directory and removes the source", func() {
+			Expect(c.MovePath(filepath.Join(srcDir, "deps"), filepath.Join(destDir, "deps"), logger)).To(Succeed())
+
+			Expect(filepath.Join(srcDir, "deps")).NotTo(BeADirectory())
+			Expect(ioutil.ReadFile(filepath.Join(destDir, "deps", "0", "bin", "ruby"))).To(Equal([]byte("ruby")))
+		})
+
+		It("returns errors other than crossing filesystems", func() {
+			Expect(c.MovePath(filepath.Join(srcDir, "missing"), filepath.Join(destDir, "deps"), logger)).NotTo(Succeed())
+		})
+
+		Context("the destination is on another filesystem", func() {
+			var otherDir string
+
+			BeforeEach(func() {
+				var srcStat, otherStat syscall.Stat_t
+				Expect(syscall.Stat(srcDir, &srcStat)).To(Succeed())
+				if err := syscall.Stat("/dev/shm", &otherStat); err != nil || otherStat.Dev == srcStat.Dev {
+					Skip("/dev/shm is not on another filesystem")
+				}
+
+				otherDir, err = ioutil.TempDir("/dev/shm", "dest")
+				Expect(err).To(BeNil())
+			})
+
+			AfterEach(func() {
+				Expect(os.RemoveAll(otherDir)).To(Succeed())
+			})
+
+			It("copies the directory and removes the source", func() {
+				Expect(c.MovePath(filepath.Join(srcDir, "deps"), filepath.Join(otherDir, "deps"), logger)).To(Succeed())
+
+				Expect(filepath.Join(srcDir, "deps")).NotTo(BeADirectory())
+				Expect(ioutil.ReadFile(filepath.Join(otherDir, "deps", "0", "bin", "ruby"))).To(Equal([]byte("ruby")))
+				Expect(os.Readlink(filepath.Join(otherDir, "deps", "0", "ruby"))).To(Equal("bin/ruby"))
+			})
+
+			Context("the destination already exists", func() {
+				BeforeEach(func() {
+					Expect(os.MkdirAll(filepath.Join(otherDir, "deps"), 0755)).To(Succeed())
+					Expect(ioutil.WriteFile(filepath.Join(otherDir, "deps", "app.txt"), []byte("app"), 0644)).To(Succeed())
+				})
+
+				It("fails without touching either side", func() {
+					Expect(c.MovePath(filepath.Join(srcDir, "deps"), filepath.Join(otherDir, "deps"), logger)).NotTo(Succeed())
+
+					Expect(ioutil.ReadFile(filepath.Join(otherDir, "deps", "app.txt"))).To(Equal([]byte("app")))
+					Expect(filepath.Join(otherDir, "deps", "0")).NotTo(BeADirectory())
+					Expect(ioutil.ReadFile(filepath.Join(srcDir, "deps", "0", "bin", "ruby"))).To(Equal([]byte("ruby")))
+				})
+			})
+
+			Context("the destination is an existing file", func() {
+				BeforeEach(func() {
+					Expect(ioutil.WriteFile(filepath.Join(otherDir, "deps"), []byte("app"), 0644)).To(Succeed())
+				})
+
+				It("fails without touching either side", func() {
+					Expect(c.MovePath(filepath.Join(srcDir, "deps"), filepath.Join(otherDir, "deps"), logger)).NotTo(Succeed())
+
+					Expect(ioutil.ReadFile(filepath.Join(otherDir, "deps"))).To(Equal([]byte("app")))
+					Expect(ioutil.ReadFile(filepath.Join(srcDir, "deps", "0", "bin", "ruby"))).To(Equal([]byte("ruby")))
+				})
+			})
+		})
+	})
+})
@@ -1,28 +1,300 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
 
+	"code.cloudfoundry.org/bytefmt"
 	"github.com/cloudfoundry/libbuildpack"
 )
 
 // Config is a struct to parse multi-buildpack.yml
 type MultiBuildpackMetadata struct {
-	Buildpacks []string `yaml:"buildpacks"`
+	Entries         []BuildpackEntry  `yaml:"buildpacks"`
+	Cache           CacheMetadata     `yaml:"cache"`
+	StartFrom       string            `yaml:"start_from"`
+	Processes       map[string]string `yaml:"processes"`
+	MergeConfigVars bool              `yaml:"merge_config_vars"`
+	Env             map[string]string `yaml:"env"`
+	Decorators      []string          `yaml:"decorators"`
+	Auto            bool              `yaml:"auto"`
+	FinalCandidates []string          `yaml:"final_candidates"`
+
+	// Buildpacks are the URLs of the entries
+	Buildpacks []string `yaml:"-"`
+	// Source is the file the buildpacks were listed in
+	Source string `yaml:"-"`
+
+	// listed are the URLs of the entries before ResolveBuildpacks narrowed
+	// them down
+	listed []string
 }
 
-// NewConfig returns parsed config object
-func GetBuildpacks(dir string, logger *libbuildpack.Logger) ([]string, error) {
-	metadata := &MultiBuildpackMetadata{}
+// BuildpackEntry is an item of the buildpacks list: either a buildpack URL,
+// or a map of the URL and its options
+type BuildpackEntry struct {
+	URL string `yaml:"url"`
+	// BuildOnly removes the deps the buildpack supplied from the droplet
+	// once every buildpack has run
+	BuildOnly bool `yaml:"build_only"`
+	// Optional skips the buildpack, rather than failing staging, when it
+	// cannot be downloaded or its supply fails
+	Optional bool `yaml:"optional"`
+	// When includes the buildpack only if its conditions hold
+	When *BuildpackCondition `yaml:"when"`
+
+	// position is the index of the entry in the buildpacks list
+	position int
+}
+
+// UnmarshalYAML reads a buildpack URL or a map with a url
+func (e *BuildpackEntry) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&e.URL); err == nil {
+		return nil
+	}
+
+	type entry BuildpackEntry
+	return unmarshal((*entry)(e))
+}
+
+// the places the buildpacks can be listed in
+const (
+	MultiBuildpackYmlSource = "multi-buildpack.yml"
+	BuildpacksFileSource    = ".buildpacks"
+	AppManifestSource       = "manifest.yml (applications[0].buildpacks)"
+)
 
-	err := libbuildpack.NewYAML().Load(filepath.Join(dir, "multi-buildpack.yml"), metadata)
+// CacheMetadata is the cache section of multi-buildpack.yml
+type CacheMetadata struct {
+	Limit string `yaml:"limit"`
+	Clear string `yaml:"clear"`
+}
+
+// CacheLimit returns the per-buildpack build cache size cap in bytes, 0 if
+// there is none
+func (m *MultiBuildpackMetadata) CacheLimit() (uint64, error) {
+	if m.Cache.Limit == "" {
+		return 0, nil
+	}
+
+	limit, err := bytefmt.ToBytes(m.Cache.Limit)
 	if err != nil {
-		if os.IsNotExist(err) {
-			logger.Error("A multi-buildpack.yml file must be provided at your app root to use this buildpack.")
-		} else {
+		return 0, fmt.Errorf("invalid cache limit %s: %s", m.Cache.Limit, err.Error())
+	}
+	return limit, nil
+}
+
+// GetMultiBuildpackMetadata returns the parsed and validated multi-buildpack.yml.
+// Without one, it falls back to a Heroku style .buildpacks file, then to the
+// buildpacks list of the first application in the app's manifest.yml.
+func GetMultiBuildpackMetadata(dir string, logger *libbuildpack.Logger) (*MultiBuildpackMetadata, error) {
+	metadata := &MultiBuildpackMetadata{Source: MultiBuildpackYmlSource}
+
+	hasBuildpacksFile, err := libbuildpack.FileExists(filepath.Join(dir, ".buildpacks"))
+	if err != nil {
+		logger.Error("Unable to read the .buildpacks file: %s", err.Error())
+		return nil, err
+	}
+
+	err = libbuildpack.NewYAML().Load(filepath.Join(dir, "multi-buildpack.yml"), metadata)
+	if err == nil && hasBuildpacksFile {
+		err := errors.New("both multi-buildpack.yml and .buildpacks exist")
+		logger.Error("Both a multi-buildpack.yml and a .buildpacks file were provided. Remove one of them to choose the buildpacks.")
+		return nil, err
+	} else if err != nil {
+		if !os.IsNotExist(err) {
 			logger.Error("The multi-buildpack.yml file is malformed.")
+			return nil, err
+		}
+
+		if hasBuildpacksFile {
+			buildpacks, err := ReadBuildpacksFile(filepath.Join(dir, ".buildpacks"))
+			if err != nil {
+				logger.Error("Unable to read the .buildpacks file: %s", err.Error())
+				return nil, err
+			}
+			metadata.Entries = buildpackEntries(buildpacks)
+			metadata.Source = BuildpacksFileSource
+		} else {
+			buildpacks, found := GetAppManifestBuildpacks(dir)
+			if !found {
+				logger.Error("A multi-buildpack.yml file must be provided at your app root to use this buildpack.")
+				return nil, err
+			}
+			if err := checkAppManifestBuildpacks(buildpacks); err != nil {
+				logger.Error("Unable to use the buildpacks listed in %s: %s", AppManifestSource, err.Error())
+				return nil, err
+			}
+			metadata.Entries = buildpackEntries(buildpacks)
+			metadata.Source = AppManifestSource
+		}
+	}
+
+	metadata.Buildpacks = entryURLs(metadata.Entries)
+
+	if len(metadata.Buildpacks) == 0 && len(metadata.FinalCandidates) == 0 {
+		err := errors.New("no buildpacks are listed")
+		logger.Error("The %s file is malformed: %s", metadata.Source, err.Error())
+		return nil, err
+	}
+	for i, buildpack := range metadata.Buildpacks {
+		if strings.TrimSpace(buildpack) == "" {
+			err := fmt.Errorf("buildpack %d is empty", i)
+			logger.Error("The %s file is malformed: %s", metadata.Source, err.Error())
+			return nil, err
+		}
+	}
+
+	for i, candidate := range metadata.FinalCandidates {
+		if strings.TrimSpace(candidate) == "" {
+			err := fmt.Errorf("final candidate %d is empty", i)
+			logger.Error("The %s file is malformed: %s", metadata.Source, err.Error())
+			return nil, err
+		}
+	}
+
+	for i, decorator := range metadata.Decorators {
+		if strings.TrimSpace(decorator) == "" {
+			err := fmt.Errorf("decorator %d is empty", i)
+			logger.Error("The %s file is malformed: %s", metadata.Source, err.Error())
+			return nil, err
+		}
+	}
+
+	// with final_candidates, every listed buildpack is a supply buildpack
+	if len(metadata.FinalCandidates) == 0 {
+		if final := metadata.Entries[len(metadata.Entries)-1]; final.BuildOnly || final.Optional {
+			err := errors.New("the final buildpack cannot be build_only or optional")
+			logger.Error("The %s file is malformed: %s", metadata.Source, err.Error())
+			return nil, err
+		}
+		if metadata.Entries[len(metadata.Entries)-1].When != nil {
+			err := errors.New("the final buildpack cannot have a when condition")
+			logger.Error("The %s file is malformed: %s", metadata.Source, err.Error())
+			return nil, err
+		}
+	}
+
+	if _, err := metadata.CacheLimit(); err != nil {
+		logger.Error("The %s file is malformed: %s", metadata.Source, err.Error())
+		return nil, err
+	}
+
+	for name, command := range metadata.Processes {
+		if command == "" {
+			err := fmt.Errorf("process %s has no command", name)
+			logger.Error("The %s file is malformed: %s", metadata.Source, err.Error())
+			return nil, err
+		}
+	}
+
+	return metadata, nil
+}
+
+// BuildOnlyIndexes returns the indexes of the build_only buildpacks
+func (m *MultiBuildpackMetadata) BuildOnlyIndexes() []int {
+	return m.entryIndexes(func(entry BuildpackEntry) bool { return entry.BuildOnly })
+}
+
+// OptionalIndexes returns the indexes of the optional buildpacks
+func (m *MultiBuildpackMetadata) OptionalIndexes() []int {
+	return m.entryIndexes(func(entry BuildpackEntry) bool { return entry.Optional })
+}
+
+func (m *MultiBuildpackMetadata) entryIndexes(match func(BuildpackEntry) bool) []int {
+	indexes := []int{}
+	for i, entry := range m.Entries {
+		if match(entry) {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
+func entryURLs(entries []BuildpackEntry) []string {
+	urls := []string{}
+	for _, entry := range entries {
+		urls = append(urls, entry.URL)
+	}
+	return urls
+}
+
+func buildpackEntries(buildpacks []string) []BuildpackEntry {
+	entries := []BuildpackEntry{}
+	for _, buildpack := range buildpacks {
+		entries = append(entries, BuildpackEntry{URL: buildpack})
+	}
+	return entries
+}
+
+// ReadBuildpacksFile returns the buildpacks listed one per line in a Heroku
+// style .buildpacks file. Blank lines and # comments are skipped; a # with no
+// space before it is a git ref, and kept.
+func ReadBuildpacksFile(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	buildpacks := []string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		if i := strings.IndexAny(line, " \t"); i >= 0 {
+			if comment := strings.TrimSpace(line[i:]); strings.HasPrefix(comment, "#") {
+				line = line[:i]
+			}
 		}
+		if line != "" {
+			buildpacks = append(buildpacks, line)
+		}
+	}
+	return buildpacks, nil
+}
+
+// GetAppManifestBuildpacks returns the buildpacks listed for the first
+// application in the app's manifest.yml, if any
+func GetAppManifestBuildpacks(dir string) ([]string, bool) {
+	manifest := struct {
+		Applications []struct {
+			Buildpacks []string `yaml:"buildpacks"`
+		} `yaml:"applications"`
+	}{}
+
+	if err := libbuildpack.NewYAML().Load(filepath.Join(dir, "manifest.yml"), &manifest); err != nil {
+		return nil, false
+	}
+	if len(manifest.Applications) == 0 || len(manifest.Applications[0].Buildpacks) == 0 {
+		return nil, false
+	}
+	return manifest.Applications[0].Buildpacks, true
+}
+
+// checkAppManifestBuildpacks rejects the system buildpack names app manifests
+// usually list, and the multi-buildpack itself, neither of which can be run
+func checkAppManifestBuildpacks(buildpacks []string) error {
+	for _, buildpack := range buildpacks {
+		if u, err := url.Parse(buildpack); err != nil || !u.IsAbs() {
+			return fmt.Errorf("%s is not a buildpack URL; system buildpacks cannot be used, list their URLs instead", buildpack)
+		}
+		if BuildpackName(buildpack) == "multi" {
+			return fmt.Errorf("%s is the multi-buildpack itself", buildpack)
+		}
+	}
+	return nil
+}
+
+// NewConfig returns parsed config object
+func GetBuildpacks(dir string, logger *libbuildpack.Logger) ([]string, error) {
+	metadata, err := GetMultiBuildpackMetadata(dir, logger)
+	if err != nil {
 		return nil, err
 	}
 
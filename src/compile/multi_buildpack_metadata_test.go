@@ -68,6 +68,269 @@ var _ = Describe("GetBuildpacks", func() {
 		})
 	})
 
+	Context("multi-buildpack.yml sets a cache limit", func() {
+		BeforeEach(func() {
+			content := "buildpacks:\n- some-buildpack\ncache:\n  limit: 512M"
+			err = ioutil.WriteFile(filepath.Join(buildDir, "multi-buildpack.yml"), []byte(content), 0444)
+			Expect(err).To(BeNil())
+		})
+
+		It("returns the limit in bytes", func() {
+			metadata, err := c.GetMultiBuildpackMetadata(buildDir, logger)
+			Expect(err).To(BeNil())
+			Expect(metadata.CacheLimit()).To(Equal(uint64(512 * 1024 * 1024)))
+		})
+	})
+
+	Context("multi-buildpack.yml has an invalid cache limit", func() {
+		BeforeEach(func() {
+			content := "buildpacks:\n- some-buildpack\ncache:\n  limit: lots"
+			err = ioutil.WriteFile(filepath.Join(buildDir, "multi-buildpack.yml"), []byte(content), 0444)
+			Expect(err).To(BeNil())
+		})
+
+		It("returns an error", func() {
+			_, err := c.GetBuildpacks(buildDir, logger)
+			Expect(err).ToNot(BeNil())
+		})
+
+		It("informs the user", func() {
+			c.GetBuildpacks(buildDir, logger)
+			Expect(buffer.String()).To(ContainSubstring("The multi-buildpack.yml file is malformed: invalid cache limit lots"))
+		})
+	})
+
+	Context("multi-buildpack.yml overrides the start command", func() {
+		BeforeEach(func() {
+			content := "buildpacks:\n- ruby-buildpack\n- go-buildpack\nstart_from: go\nprocesses:\n  worker: bin/worker\nmerge_config_vars: true\ndecorators:\n- apm-decorator\nauto: true\n"
+			err = ioutil.WriteFile(filepath.Join(buildDir, "multi-buildpack.yml"), []byte(content), 0444)
+			Expect(err).To(BeNil())
+		})
+
+		It("returns start_from, the processes, merge_config_vars, the decorators and auto", func() {
+			metadata, err := c.GetMultiBuildpackMetadata(buildDir, logger)
+			Expect(err).To(BeNil())
+			Expect(metadata.StartFrom).To(Equal("go"))
+			Expect(metadata.Processes).To(Equal(map[string]string{"worker": "bin/worker"}))
+			Expect(metadata.MergeConfigVars).To(BeTrue())
+			Expect(metadata.Decorators).To(Equal([]string{"apm-decorator"}))
+			Expect(metadata.Auto).To(BeTrue())
+		})
+	})
+
+	Context("multi-buildpack.yml has a process without a command", func() {
+		BeforeEach(func() {
+			content := "buildpacks:\n- some-buildpack\nprocesses:\n  worker:\n"
+			err = ioutil.WriteFile(filepath.Join(buildDir, "multi-buildpack.yml"), []byte(content), 0444)
+			Expect(err).To(BeNil())
+		})
+
+		It("returns an error and informs the user", func() {
+			_, err := c.GetMultiBuildpackMetadata(buildDir, logger)
+			Expect(err).ToNot(BeNil())
+			Expect(buffer.String()).To(ContainSubstring("The multi-buildpack.yml file is malformed: process worker has no command"))
+		})
+	})
+
+	Context("multi-buildpack.yml lists no buildpacks", func() {
+		BeforeEach(func() {
+			err = ioutil.WriteFile(filepath.Join(buildDir, "multi-buildpack.yml"), []byte("buildpacks: []\n"), 0444)
+			Expect(err).To(BeNil())
+		})
+
+		It("returns an error and informs the user", func() {
+			_, err := c.GetBuildpacks(buildDir, logger)
+			Expect(err).ToNot(BeNil())
+			Expect(buffer.String()).To(ContainSubstring("The multi-buildpack.yml file is malformed: no buildpacks are listed"))
+		})
+	})
+
+	Context("multi-buildpack.yml has buildpacks with options", func() {
+		BeforeEach(func() {
+			content := "buildpacks:\n- url: https://github.com/cloudfoundry/nodejs-buildpack\n  build_only: true\n- url: https://example.com/apm-buildpack\n  optional: true\n  when:\n    service_label: newrelic\n- https://github.com/cloudfoundry/ruby-buildpack\n"
+			err = ioutil.WriteFile(filepath.Join(buildDir, "multi-buildpack.yml"), []byte(content), 0444)
+			Expect(err).To(BeNil())
+		})
+
+		It("returns the buildpack URLs and the indexes of the build_only and optional ones", func() {
+			metadata, err := c.GetMultiBuildpackMetadata(buildDir, logger)
+			Expect(err).To(BeNil())
+			Expect(metadata.Buildpacks).To(Equal([]string{"https://github.com/cloudfoundry/nodejs-buildpack", "https://example.com/apm-buildpack", "https://github.com/cloudfoundry/ruby-buildpack"}))
+			Expect(metadata.BuildOnlyIndexes()).To(Equal([]int{0}))
+			Expect(metadata.OptionalIndexes()).To(Equal([]int{1}))
+			Expect(metadata.Entries[1].When).To(Equal(&c.BuildpackCondition{ServiceLabel: "newrelic"}))
+		})
+	})
+
+	Context("multi-buildpack.yml has final_candidates", func() {
+		BeforeEach(func() {
+			content := "buildpacks:\n- url: https://example.com/apm-buildpack\n  optional: true\nfinal_candidates:\n- https://github.com/cloudfoundry/ruby-buildpack\n- https://github.com/cloudfoundry/go-buildpack\n"
+			err = ioutil.WriteFile(filepath.Join(buildDir, "multi-buildpack.yml"), []byte(content), 0444)
+			Expect(err).To(BeNil())
+		})
+
+		It("returns them, treating every listed buildpack as a supply buildpack", func() {
+			metadata, err := c.GetMultiBuildpackMetadata(buildDir, logger)
+			Expect(err).To(BeNil())
+			Expect(metadata.Buildpacks).To(Equal([]string{"https://example.com/apm-buildpack"}))
+			Expect(metadata.FinalCandidates).To(Equal([]string{"https://github.com/cloudfoundry/ruby-buildpack", "https://github.com/cloudfoundry/go-buildpack"}))
+		})
+	})
+
+	Context("multi-buildpack.yml only has final_candidates", func() {
+		BeforeEach(func() {
+			content := "final_candidates:\n- https://github.com/cloudfoundry/ruby-buildpack\n"
+			err = ioutil.WriteFile(filepath.Join(buildDir, "multi-buildpack.yml"), []byte(content), 0444)
+			Expect(err).To(BeNil())
+		})
+
+		It("returns them", func() {
+			metadata, err := c.GetMultiBuildpackMetadata(buildDir, logger)
+			Expect(err).To(BeNil())
+			Expect(metadata.Buildpacks).To(BeEmpty())
+			Expect(metadata.FinalCandidates).To(Equal([]string{"https://github.com/cloudfoundry/ruby-buildpack"}))
+		})
+	})
+
+	Context("multi-buildpack.yml has a final buildpack with a when condition", func() {
+		BeforeEach(func() {
+			content := "buildpacks:\n- url: https://example.com/newrelic-buildpack\n  when:\n    service_label: newrelic\n- url: https://github.com/cloudfoundry/ruby-buildpack\n  when:\n    service_tag: ruby\n"
+			err = ioutil.WriteFile(filepath.Join(buildDir, "multi-buildpack.yml"), []byte(content), 0444)
+			Expect(err).To(BeNil())
+		})
+
+		It("returns an error and informs the user", func() {
+			_, err := c.GetMultiBuildpackMetadata(buildDir, logger)
+			Expect(err).ToNot(BeNil())
+			Expect(buffer.String()).To(ContainSubstring("The multi-buildpack.yml file is malformed: the final buildpack cannot have a when condition"))
+		})
+	})
+
+	Context("multi-buildpack.yml has a build_only final buildpack", func() {
+		BeforeEach(func() {
+			content := "buildpacks:\n- https://github.com/cloudfoundry/nodejs-buildpack\n- url: https://github.com/cloudfoundry/ruby-buildpack\n  build_only: true\n"
+			err = ioutil.WriteFile(filepath.Join(buildDir, "multi-buildpack.yml"), []byte(content), 0444)
+			Expect(err).To(BeNil())
+		})
+
+		It("returns an error and informs the user", func() {
+			_, err := c.GetMultiBuildpackMetadata(buildDir, logger)
+			Expect(err).ToNot(BeNil())
+			Expect(buffer.String()).To(ContainSubstring("The multi-buildpack.yml file is malformed: the final buildpack cannot be build_only or optional"))
+		})
+	})
+
+	Context("a .buildpacks file lists the buildpacks", func() {
+		BeforeEach(func() {
+			content := "# assets\nhttps://github.com/heroku/heroku-buildpack-nodejs#v121\n\n  https://github.com/heroku/heroku-buildpack-ruby.git # the app\n"
+			err = ioutil.WriteFile(filepath.Join(buildDir, ".buildpacks"), []byte(content), 0444)
+			Expect(err).To(BeNil())
+		})
+
+		It("returns the buildpacks, keeping their git refs", func() {
+			metadata, err := c.GetMultiBuildpackMetadata(buildDir, logger)
+			Expect(err).To(BeNil())
+			Expect(metadata.Buildpacks).To(Equal([]string{"https://github.com/heroku/heroku-buildpack-nodejs#v121", "https://github.com/heroku/heroku-buildpack-ruby.git"}))
+			Expect(metadata.Source).To(Equal(c.BuildpacksFileSource))
+		})
+
+		Context("multi-buildpack.yml exists too", func() {
+			BeforeEach(func() {
+				err = ioutil.WriteFile(filepath.Join(buildDir, "multi-buildpack.yml"), []byte("buildpacks:\n- some-buildpack\n"), 0444)
+				Expect(err).To(BeNil())
+			})
+
+			It("returns an error and informs the user", func() {
+				_, err := c.GetMultiBuildpackMetadata(buildDir, logger)
+				Expect(err).ToNot(BeNil())
+				Expect(buffer.String()).To(ContainSubstring("Both a multi-buildpack.yml and a .buildpacks file were provided"))
+			})
+		})
+
+		Context("it only has comments", func() {
+			BeforeEach(func() {
+				err = ioutil.WriteFile(filepath.Join(buildDir, ".buildpacks"), []byte("# nothing yet\n"), 0644)
+				Expect(err).To(BeNil())
+			})
+
+			It("returns an error and informs the user", func() {
+				_, err := c.GetMultiBuildpackMetadata(buildDir, logger)
+				Expect(err).ToNot(BeNil())
+				Expect(buffer.String()).To(ContainSubstring("The .buildpacks file is malformed: no buildpacks are listed"))
+			})
+		})
+	})
+
+	Context("multi-buildpack.yml does not exist but manifest.yml lists buildpacks", func() {
+		BeforeEach(func() {
+			content := "---\napplications:\n- name: my-app\n  buildpacks:\n  - https://github.com/cloudfoundry/nodejs-buildpack\n  - https://github.com/cloudfoundry/ruby-buildpack\n- name: my-worker\n  buildpacks:\n  - https://github.com/cloudfoundry/go-buildpack\n"
+			err = ioutil.WriteFile(filepath.Join(buildDir, "manifest.yml"), []byte(content), 0444)
+			Expect(err).To(BeNil())
+		})
+
+		It("returns the buildpacks of the first application", func() {
+			metadata, err := c.GetMultiBuildpackMetadata(buildDir, logger)
+			Expect(err).To(BeNil())
+			Expect(metadata.Buildpacks).To(Equal([]string{"https://github.com/cloudfoundry/nodejs-buildpack", "https://github.com/cloudfoundry/ruby-buildpack"}))
+			Expect(metadata.Source).To(Equal(c.AppManifestSource))
+		})
+
+		Context("multi-buildpack.yml exists too", func() {
+			BeforeEach(func() {
+				err = ioutil.WriteFile(filepath.Join(buildDir, "multi-buildpack.yml"), []byte("buildpacks:\n- some-buildpack\n"), 0444)
+				Expect(err).To(BeNil())
+			})
+
+			It("uses multi-buildpack.yml", func() {
+				metadata, err := c.GetMultiBuildpackMetadata(buildDir, logger)
+				Expect(err).To(BeNil())
+				Expect(metadata.Buildpacks).To(Equal([]string{"some-buildpack"}))
+				Expect(metadata.Source).To(Equal(c.MultiBuildpackYmlSource))
+			})
+		})
+	})
+
+	Context("manifest.yml lists system buildpacks", func() {
+		BeforeEach(func() {
+			content := "---\napplications:\n- name: my-app\n  buildpacks:\n  - nodejs_buildpack\n  - https://github.com/cloudfoundry/ruby-buildpack\n"
+			err = ioutil.WriteFile(filepath.Join(buildDir, "manifest.yml"), []byte(content), 0444)
+			Expect(err).To(BeNil())
+		})
+
+		It("returns an error and informs the user", func() {
+			_, err := c.GetMultiBuildpackMetadata(buildDir, logger)
+			Expect(err).NotTo(BeNil())
+			Expect(buffer.String()).To(ContainSubstring("nodejs_buildpack is not a buildpack URL; system buildpacks cannot be used"))
+		})
+	})
+
+	Context("manifest.yml lists the multi-buildpack itself", func() {
+		BeforeEach(func() {
+			content := "---\napplications:\n- name: my-app\n  buildpacks:\n  - https://github.com/cloudfoundry/multi-buildpack\n"
+			err = ioutil.WriteFile(filepath.Join(buildDir, "manifest.yml"), []byte(content), 0444)
+			Expect(err).To(BeNil())
+		})
+
+		It("returns an error and informs the user", func() {
+			_, err := c.GetMultiBuildpackMetadata(buildDir, logger)
+			Expect(err).NotTo(BeNil())
+			Expect(buffer.String()).To(ContainSubstring("https://github.com/cloudfoundry/multi-buildpack is the multi-buildpack itself"))
+		})
+	})
+
+	Context("multi-buildpack.yml does not exist and manifest.yml lists no buildpacks", func() {
+		BeforeEach(func() {
+			err = ioutil.WriteFile(filepath.Join(buildDir, "manifest.yml"), []byte("---\napplications:\n- name: my-app\n  buildpack: ruby_buildpack\n"), 0444)
+			Expect(err).To(BeNil())
+		})
+
+		It("returns an error and informs the user", func() {
+			_, err := c.GetBuildpacks(buildDir, logger)
+			Expect(err).ToNot(BeNil())
+			Expect(buffer.String()).To(ContainSubstring("A multi-buildpack.yml file must be provided at your app root to use this buildpack."))
+		})
+	})
+
 	Context("multi-buildpack.yml does not exist", func() {
 		It("returns an error", func() {
 			_, err := c.GetBuildpacks(buildDir, logger)
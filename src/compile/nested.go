@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/cloudfoundry/libbuildpack"
+)
+
+// the deps sub dirs the platform and the final buildpack look for in each
+// deps dir
+var nestedDepsLinkDirs = []string{"bin", "lib", "include", "pkgconfig"}
+
+// nestedDepsPath matches the $DEPS_DIR/<idx> paths in the profile.d scripts
+// of the nested final buildpack
+var nestedDepsPath = regexp.MustCompile(`(\$DEPS_DIR|\$\{DEPS_DIR\})/([0-9]+)\b`)
+
+// NestedDownloadsDir keeps the buildpacks downloaded by supply for finalize,
+// which runs in a separate process
+func NestedDownloadsDir(depsIdx string) string {
+	return filepath.Join(os.TempDir(), "multi-buildpack-"+depsIdx+"-buildpacks")
+}
+
+// Supply runs the supply step of each buildpack when the multi-buildpack is
+// one of the buildpacks pushed with `cf push -b`. Each buildpack gets a sub
+// dir of the multi-buildpack's deps dir, depsDir/depsIdx, as its own.
+func (c *MultiCompiler) Supply(depsDir, depsIdx string) error {
+	config, err := c.NewLifecycleBuilderConfig()
+	if err != nil {
+		c.Log.Error("Unable to set up runner config: %s", err.Error())
+		return err
+	}
+
+	nestedDepsDir := filepath.Join(depsDir, depsIdx)
+	cache := NewBuildpackCache(config.BuildArtifactsCacheDir(), c.CacheLimit, c.ClearCache, c.Log)
+	runner := NewBuildpackRunner(&config, cache, c.Log)
+	runner.Optional = c.Optional
+
+	if err := runner.Supply(nestedDepsDir); err != nil {
+		c.Log.Error("Unable to run all buildpacks: %s", err.Error())
+		return err
+	}
+
+	if err := c.LinkNestedDeps(nestedDepsDir); err != nil {
+		c.Log.Error("Unable to link the buildpacks' deps: %s", err.Error())
+		return err
+	}
+
+	return nil
+}
+
+// Finalize runs the finalize step of the final buildpack after Supply, when
+// the multi-buildpack is the final buildpack pushed with `cf push -b`
+func (c *MultiCompiler) Finalize(depsDir, depsIdx, profileDir string) error {
+	config, err := c.NewLifecycleBuilderConfig()
+	if err != nil {
+		c.Log.Error("Unable to set up runner config: %s", err.Error())
+		return err
+	}
+
+	if err := RemoveRelease(c.BuildDir); err != nil {
+		c.Log.Error("Unable to remove the previous release: %s", err.Error())
+		return err
+	}
+
+	nestedDepsDir := filepath.Join(depsDir, depsIdx)
+	cache := NewBuildpackCache(config.BuildArtifactsCacheDir(), c.CacheLimit, []string{}, c.Log)
+	runner := NewBuildpackRunner(&config, cache, c.Log)
+	runner.StartFrom = c.StartFrom
+	runner.Processes = c.Processes
+	runner.MergeConfigVars = c.MergeConfigVars
+	runner.Optional = c.Optional
+	runner.Decorators = c.Decorators
+
+	existingScripts, err := ListProfileScripts(profileDir)
+	if err != nil {
+		c.Log.Error("Unable to read %s: %s", profileDir, err.Error())
+		return err
+	}
+
+	stagingInfoFile, err := runner.Finalize(nestedDepsDir, profileDir)
+	if err != nil {
+		c.Log.Error("Unable to run all buildpacks: %s", err.Error())
+		return err
+	}
+
+	if err := os.RemoveAll(c.DownloadsDir); err != nil {
+		c.Log.Warning("Unable to remove downloaded buildpacks: %s", err.Error())
+	}
+
+	if err := c.RemoveBuildOnlyDeps(nestedDepsDir, profileDir, ""); err != nil {
+		c.Log.Error("Unable to remove build-only buildpacks: %s", err.Error())
+		return err
+	}
+
+	if err := c.LinkNestedDeps(nestedDepsDir); err != nil {
+		c.Log.Error("Unable to link the buildpacks' deps: %s", err.Error())
+		return err
+	}
+
+	if err := c.SetNestedLaunchEnvironment(depsDir, depsIdx, profileDir, existingScripts); err != nil {
+		c.Log.Error("Unable to set up the launch environment: %s", err.Error())
+		return err
+	}
+
+	err = WriteStartCommand(stagingInfoFile, c.BuildDir)
+	if err != nil {
+		c.Log.Error("Unable to write start command: %s", err.Error())
+		return err
+	}
+
+	return os.RemoveAll(filepath.Dir(stagingInfoFile))
+}
+
+// LinkNestedDeps exposes the deps the buildpacks supplied into the numbered
+// sub dirs of nestedDepsDir to the platform, which only looks one level
+// down: their bin, lib, include and pkgconfig files are linked into
+// nestedDepsDir, their env files copied and their profile.d scripts wrapped
+// to run with DEPS_DIR pointing at nestedDepsDir
+func (c *MultiCompiler) LinkNestedDeps(nestedDepsDir string) error {
+	indexes, err := nestedDepsIndexes(nestedDepsDir)
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range append(nestedDepsLinkDirs, "env", "profile.d") {
+		if err := os.RemoveAll(filepath.Join(nestedDepsDir, dir)); err != nil {
+			return err
+		}
+	}
+
+	// later buildpacks override earlier ones, as they do in the staging
+	// environment
+	for _, idx := range indexes {
+		for _, dir := range nestedDepsLinkDirs {
+			files, err := readDirIfExists(filepath.Join(nestedDepsDir, idx, dir))
+			if err != nil {
+				return err
+			}
+			for _, file := range files {
+				if err := os.MkdirAll(filepath.Join(nestedDepsDir, dir), 0755); err != nil {
+					return err
+				}
+				dest := filepath.Join(nestedDepsDir, dir, file.Name())
+				if err := os.RemoveAll(dest); err != nil {
+					return err
+				}
+				if err := os.Symlink(filepath.Join("..", idx, dir, file.Name()), dest); err != nil {
+					return err
+				}
+			}
+		}
+
+		files, err := readDirIfExists(filepath.Join(nestedDepsDir, idx, "env"))
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if !file.Mode().IsRegular() {
+				continue
+			}
+			data, err := ioutil.ReadFile(filepath.Join(nestedDepsDir, idx, "env", file.Name()))
+			if err != nil {
+				return err
+			}
+			if err := os.MkdirAll(filepath.Join(nestedDepsDir, "env"), 0755); err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(filepath.Join(nestedDepsDir, "env", file.Name()), data, 0644); err != nil {
+				return err
+			}
+		}
+
+		files, err = readDirIfExists(filepath.Join(nestedDepsDir, idx, "profile.d"))
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if !file.Mode().IsRegular() {
+				continue
+			}
+			script, err := ioutil.ReadFile(filepath.Join(nestedDepsDir, idx, "profile.d", file.Name()))
+			if err != nil {
+				return err
+			}
+			if err := os.MkdirAll(filepath.Join(nestedDepsDir, "profile.d"), 0755); err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(filepath.Join(nestedDepsDir, "profile.d", idx+"_"+file.Name()), []byte(nestedProfileScript(filepath.Base(nestedDepsDir), string(script))), 0755); err != nil {
+				return err
+			}
+		}
+	}
+
+	return ioutil.WriteFile(filepath.Join(nestedDepsDir, "config.yml"), []byte("name: multi-buildpack\n"), 0644)
+}
+
+// SetNestedLaunchEnvironment fixes up the profile.d scripts the nested final
+// buildpack wrote into profileDir, which see depsDir/depsIdx as the whole
+// deps dir. Its copies of the buildpacks' profile.d scripts give way to the
+// wrapped ones LinkNestedDeps wrote, the $DEPS_DIR/<idx> paths in its own
+// scripts move under $DEPS_DIR/depsIdx, and the launch environment is set
+// up again over depsDir, so the deps of the buildpacks before the
+// multi-buildpack are on the PATH too. Scripts in existingScripts were there
+// before it ran and are left alone.
+func (c *MultiCompiler) SetNestedLaunchEnvironment(depsDir, depsIdx, profileDir string, existingScripts []string) error {
+	existing := map[string]bool{}
+	for _, script := range existingScripts {
+		existing[script] = true
+	}
+
+	wrapped, err := readDirIfExists(filepath.Join(depsDir, depsIdx, "profile.d"))
+	if err != nil {
+		return err
+	}
+	for _, file := range wrapped {
+		if existing[file.Name()] {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(profileDir, file.Name())); err != nil {
+			return err
+		}
+	}
+
+	scripts, err := ListProfileScripts(profileDir)
+	if err != nil {
+		return err
+	}
+	for _, script := range scripts {
+		if existing[script] {
+			continue
+		}
+		path := filepath.Join(profileDir, script)
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rewritten := nestedDepsPath.ReplaceAll(contents, []byte("${1}/"+depsIdx+"/${2}"))
+		if err := ioutil.WriteFile(path, rewritten, 0755); err != nil {
+			return err
+		}
+	}
+
+	stager := libbuildpack.NewStager([]string{c.BuildDir, c.CacheDir, depsDir, depsIdx, profileDir}, c.Log, nil)
+	return stager.SetLaunchEnvironment()
+}
+
+func nestedProfileScript(depsIdx, script string) string {
+	return fmt.Sprintf(`__multi_deps_dir="$DEPS_DIR"
+export DEPS_DIR="$DEPS_DIR/%s"
+%s
+export DEPS_DIR="$__multi_deps_dir"
+unset __multi_deps_dir
+`, depsIdx, script)
+}
+
+func nestedDepsIndexes(nestedDepsDir string) ([]string, error) {
+	dirs, err := ioutil.ReadDir(nestedDepsDir)
+	if err != nil {
+		return nil, err
+	}
+
+	indexes := []string{}
+	for _, dir := range dirs {
+		if _, err := strconv.Atoi(dir.Name()); err == nil && dir.IsDir() {
+			indexes = append(indexes, dir.Name())
+		}
+	}
+	sort.Slice(indexes, func(i, j int) bool {
+		a, _ := strconv.Atoi(indexes[i])
+		b, _ := strconv.Atoi(indexes[j])
+		return a < b
+	})
+	return indexes, nil
+}
+
+func readDirIfExists(dir string) ([]os.FileInfo, error) {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return files, err
+}
@@ -0,0 +1,157 @@
+package main_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	c "compile"
+
+	"github.com/cloudfoundry/libbuildpack"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Nested deps", func() {
+	var (
+		err           error
+		depsDir       string
+		nestedDepsDir string
+		compiler      *c.MultiCompiler
+	)
+
+	BeforeEach(func() {
+		depsDir, err = ioutil.TempDir("", "deps")
+		Expect(err).To(BeNil())
+		nestedDepsDir = filepath.Join(depsDir, "1")
+
+		writeFile(filepath.Join(nestedDepsDir, "0", "bin", "node"), "#!/bin/sh\necho node 0\n")
+		writeFile(filepath.Join(nestedDepsDir, "0", "bin", "shared"), "#!/bin/sh\necho shared 0\n")
+		writeFile(filepath.Join(nestedDepsDir, "0", "env", "NODE_HOME"), "/node")
+		writeFile(filepath.Join(nestedDepsDir, "0", "profile.d", "node.sh"), "export NODE_DIR=$DEPS_DIR/0/node\n")
+		writeFile(filepath.Join(nestedDepsDir, "1", "bin", "shared"), "#!/bin/sh\necho shared 1\n")
+		writeFile(filepath.Join(nestedDepsDir, "1", "lib", "libruby.so"), "")
+
+		compiler = &c.MultiCompiler{Log: libbuildpack.NewLogger(new(bytes.Buffer))}
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(depsDir)).To(Succeed())
+	})
+
+	Describe("LinkNestedDeps", func() {
+		JustBeforeEach(func() {
+			Expect(compiler.LinkNestedDeps(nestedDepsDir)).To(Succeed())
+		})
+
+		It("links the buildpacks' bin and lib files into the deps dir", func() {
+			Expect(ioutil.ReadFile(filepath.Join(nestedDepsDir, "bin", "node"))).To(Equal([]byte("#!/bin/sh\necho node 0\n")))
+			Expect(os.Readlink(filepath.Join(nestedDepsDir, "lib", "libruby.so"))).To(Equal("../1/lib/libruby.so"))
+		})
+
+		It("lets later buildpacks override earlier ones", func() {
+			Expect(ioutil.ReadFile(filepath.Join(nestedDepsDir, "bin", "shared"))).To(Equal([]byte("#!/bin/sh\necho shared 1\n")))
+		})
+
+		It("copies the env files", func() {
+			Expect(ioutil.ReadFile(filepath.Join(nestedDepsDir, "env", "NODE_HOME"))).To(Equal([]byte("/node")))
+		})
+
+		It("wraps the profile.d scripts to see their own deps dir", func() {
+			cmd := exec.Command("bash", "-c", `source 1/profile.d/0_node.sh && echo "$NODE_DIR $DEPS_DIR"`)
+			cmd.Dir = depsDir
+			cmd.Env = append(os.Environ(), "DEPS_DIR=/home/vcap/deps")
+			output, err := cmd.Output()
+			Expect(err).To(BeNil())
+			Expect(strings.TrimSpace(string(output))).To(Equal("/home/vcap/deps/1/0/node /home/vcap/deps"))
+		})
+
+		It("names the deps dir", func() {
+			Expect(ioutil.ReadFile(filepath.Join(nestedDepsDir, "config.yml"))).To(Equal([]byte("name: multi-buildpack\n")))
+		})
+
+		Context("it has linked the deps before", func() {
+			BeforeEach(func() {
+				Expect(compiler.LinkNestedDeps(nestedDepsDir)).To(Succeed())
+				Expect(os.RemoveAll(filepath.Join(nestedDepsDir, "0", "bin", "node"))).To(Succeed())
+			})
+
+			It("links them again from scratch", func() {
+				Expect(filepath.Join(nestedDepsDir, "bin", "node")).NotTo(BeAnExistingFile())
+				Expect(filepath.Join(nestedDepsDir, "bin", "shared")).To(BeAnExistingFile())
+			})
+		})
+	})
+
+	Describe("Supply and Finalize", func() {
+		var (
+			buildDir     string
+			cacheDir     string
+			downloadsDir string
+			profileDir   string
+		)
+
+		buildpackPath := func(name string) string {
+			config, err := compiler.NewLifecycleBuilderConfig()
+			Expect(err).To(BeNil())
+			return config.BuildpackPath(name)
+		}
+
+		BeforeEach(func() {
+			Expect(os.RemoveAll(nestedDepsDir)).To(Succeed())
+			writeFile(filepath.Join(depsDir, "0", "bin", "outer"), "#!/bin/sh\necho outer\n")
+			writeFile(filepath.Join(depsDir, "0", "profile.d", "outer.sh"), "export OUTER_DIR=$DEPS_DIR/0/outer\n")
+
+			buildDir, err = ioutil.TempDir("", "build")
+			Expect(err).To(BeNil())
+			cacheDir, err = ioutil.TempDir("", "cache")
+			Expect(err).To(BeNil())
+			downloadsDir, err = ioutil.TempDir("", "downloads")
+			Expect(err).To(BeNil())
+			profileDir = filepath.Join(buildDir, ".profile.d")
+
+			compiler.BuildDir = buildDir
+			compiler.CacheDir = cacheDir
+			compiler.DownloadsDir = downloadsDir
+			compiler.Buildpacks = []string{"node_buildpack", "final_buildpack"}
+
+			writeBuildpack(buildpackPath("node_buildpack"), "", map[string]string{
+				"supply": `mkdir -p "$3/$4/bin" "$3/$4/profile.d"; printf '#!/bin/sh\necho node\n' > "$3/$4/bin/node"; chmod +x "$3/$4/bin/node"; echo 'export NODE_DIR=$DEPS_DIR/'$4'/node' > "$3/$4/profile.d/node.sh"`,
+			})
+			// writes the launch environment the way libbuildpack does
+			writeBuildpack(buildpackPath("final_buildpack"), "", map[string]string{
+				"supply": `true`,
+				"finalize": `mkdir -p "$5"
+path=""
+for dir in "$3"/[0-9]*/bin; do path="\$DEPS_DIR/$(basename "$(dirname "$dir")")/bin${path:+:$path}"; done
+echo "export PATH=$path\$([[ ! -z \"\${PATH:-}\" ]] && echo \":\$PATH\")" > "$5/000_multi-supply.sh"
+for script in "$3"/[0-9]*/profile.d/*; do cp "$script" "$5/$(basename "$(dirname "$(dirname "$script")")")_$(basename "$script")"; done
+echo 'export FINAL_DIR=$DEPS_DIR/'$4'/final' > "$5/final.sh"`,
+				"release": `echo "default_process_types:"; echo "  web: ./start"`,
+			})
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(buildDir)).To(Succeed())
+			Expect(os.RemoveAll(cacheDir)).To(Succeed())
+			Expect(os.RemoveAll(downloadsDir)).To(Succeed())
+		})
+
+		It("sets up a launch environment that sees every deps dir", func() {
+			Expect(compiler.Supply(depsDir, "1")).To(Succeed())
+			Expect(compiler.Finalize(depsDir, "1", profileDir)).To(Succeed())
+
+			Expect(filepath.Join(profileDir, "0_node.sh")).NotTo(BeAnExistingFile())
+
+			cmd := exec.Command("bash", "-c", `for script in .profile.d/*.sh; do source "$script"; done; echo "$(outer) $(node) $OUTER_DIR $NODE_DIR $FINAL_DIR"`)
+			cmd.Dir = buildDir
+			cmd.Env = append(os.Environ(), "DEPS_DIR="+depsDir)
+			output, err := cmd.Output()
+			Expect(err).To(BeNil())
+			Expect(strings.TrimSpace(string(output))).To(Equal("outer node " + depsDir + "/0/outer " + depsDir + "/1/0/node " + depsDir + "/1/1/final"))
+		})
+	})
+})
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/buildpackapplifecycle"
+	"github.com/cloudfoundry/libbuildpack"
+)
+
+// buildpackProfileScriptPrefix starts the names of the scripts installed by
+// the buildpacks. It sorts after MultiProfileScriptName, which they rely on,
+// and before the app's own scripts, which keep their names and so run last.
+const buildpackProfileScriptPrefix = "00000001_"
+
+// ListProfileScripts returns the names of the scripts in a .profile.d dir
+func ListProfileScripts(profileDir string) ([]string, error) {
+	files, err := ioutil.ReadDir(profileDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+
+	scripts := []string{}
+	for _, file := range files {
+		if !file.IsDir() {
+			scripts = append(scripts, file.Name())
+		}
+	}
+	return scripts, nil
+}
+
+// InstallProfileScripts merges the buildpack profile.d scripts into the app's
+// .profile.d, namespaced by deps index so they run before the app's own
+// scripts
+func (c *MultiCompiler) InstallProfileScripts(buildpackProfileDir string) error {
+	appProfileDir := filepath.Join(c.BuildDir, ".profile.d")
+	if err := os.MkdirAll(appProfileDir, 0755); err != nil {
+		return err
+	}
+
+	depsIdx := c.finalDepsIndex()
+
+	appScripts := map[string]bool{}
+	for _, name := range c.AppProfileScripts {
+		appScripts[name] = true
+	}
+
+	// scripts that showed up in the app's .profile.d while staging were
+	// written there by a final buildpack that only provides bin/compile
+	current, err := ListProfileScripts(appProfileDir)
+	if err != nil {
+		return err
+	}
+	for _, name := range current {
+		if appScripts[name] {
+			continue
+		}
+		if err := c.installProfileScript(filepath.Join(appProfileDir, name), installedProfileScriptName(depsIdx, name)); err != nil {
+			return err
+		}
+	}
+
+	scripts, err := ListProfileScripts(buildpackProfileDir)
+	if err != nil {
+		return err
+	}
+	for _, name := range scripts {
+		if appScripts[name] {
+			c.Log.Warning("The buildpack profile.d script %s has the same name as a script in your app's .profile.d; both will be kept", name)
+		}
+		if err := c.installProfileScript(filepath.Join(buildpackProfileDir, name), installedProfileScriptName(depsIdx, name)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *MultiCompiler) installProfileScript(src, name string) error {
+	dest := filepath.Join(c.BuildDir, ".profile.d", name)
+	if src == dest {
+		return nil
+	}
+
+	if exists, err := libbuildpack.FileExists(dest); err != nil {
+		return err
+	} else if exists {
+		return fmt.Errorf("profile.d script %s collides with existing script %s", filepath.Base(src), name)
+	}
+
+	return MovePath(src, dest, c.Log)
+}
+
+func (c *MultiCompiler) finalDepsIndex() string {
+	if len(c.Buildpacks) == 0 {
+		return "0"
+	}
+	config := buildpackapplifecycle.NewLifecycleBuilderConfig(c.Buildpacks, true, false)
+	return config.DepsIndex(len(c.Buildpacks) - 1)
+}
+
+func buildpackProfileScriptName(depsIdx, name string) string {
+	return depsIdx + "_" + name
+}
+
+// installedProfileScriptName is the name in the app's .profile.d of a script
+// from the profile.d of the buildpack at depsIdx
+func installedProfileScriptName(depsIdx, name string) string {
+	return buildpackProfileScriptPrefix + buildpackProfileScriptName(depsIdx, name)
+}
@@ -0,0 +1,121 @@
+package main_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	c "compile"
+
+	"github.com/cloudfoundry/libbuildpack"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("InstallProfileScripts", func() {
+	var (
+		err                 error
+		buildDir            string
+		buildpackProfileDir string
+		appProfileDir       string
+		compiler            *c.MultiCompiler
+		buffer              *bytes.Buffer
+	)
+
+	BeforeEach(func() {
+		buildDir, err = ioutil.TempDir("", "build")
+		Expect(err).To(BeNil())
+		appProfileDir = filepath.Join(buildDir, ".profile.d")
+
+		buildpackProfileDir, err = ioutil.TempDir("", "profile.d")
+		Expect(err).To(BeNil())
+
+		buffer = new(bytes.Buffer)
+
+		compiler = &c.MultiCompiler{
+			BuildDir:          buildDir,
+			Log:               libbuildpack.NewLogger(buffer),
+			Buildpacks:        []string{"a", "b"},
+			AppProfileScripts: []string{},
+		}
+
+		Expect(ioutil.WriteFile(filepath.Join(buildpackProfileDir, "000_multi-supply.sh"), []byte("supply"), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(buildpackProfileDir, "ruby.sh"), []byte("ruby"), 0755)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(buildDir)).To(Succeed())
+		Expect(os.RemoveAll(buildpackProfileDir)).To(Succeed())
+	})
+
+	It("namespaces the buildpack scripts by the final deps index", func() {
+		Expect(compiler.InstallProfileScripts(buildpackProfileDir)).To(Succeed())
+
+		Expect(ioutil.ReadFile(filepath.Join(appProfileDir, "00000001_1_000_multi-supply.sh"))).To(Equal([]byte("supply")))
+		Expect(ioutil.ReadFile(filepath.Join(appProfileDir, "00000001_1_ruby.sh"))).To(Equal([]byte("ruby")))
+	})
+
+	Context("the app has its own .profile.d scripts", func() {
+		BeforeEach(func() {
+			Expect(os.MkdirAll(appProfileDir, 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(appProfileDir, "ruby.sh"), []byte("app ruby"), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(appProfileDir, "0_early.sh"), []byte("app early"), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(appProfileDir, "app_ruby.sh"), []byte("app app_ruby"), 0755)).To(Succeed())
+			compiler.AppProfileScripts = []string{"ruby.sh", "0_early.sh", "app_ruby.sh"}
+		})
+
+		It("keeps their names", func() {
+			Expect(compiler.InstallProfileScripts(buildpackProfileDir)).To(Succeed())
+
+			Expect(ioutil.ReadFile(filepath.Join(appProfileDir, "0_early.sh"))).To(Equal([]byte("app early")))
+			Expect(ioutil.ReadFile(filepath.Join(appProfileDir, "app_ruby.sh"))).To(Equal([]byte("app app_ruby")))
+		})
+
+		It("keeps both scripts when names collide", func() {
+			Expect(compiler.InstallProfileScripts(buildpackProfileDir)).To(Succeed())
+
+			Expect(ioutil.ReadFile(filepath.Join(appProfileDir, "00000001_1_ruby.sh"))).To(Equal([]byte("ruby")))
+			Expect(ioutil.ReadFile(filepath.Join(appProfileDir, "ruby.sh"))).To(Equal([]byte("app ruby")))
+		})
+
+		It("reports the collision", func() {
+			Expect(compiler.InstallProfileScripts(buildpackProfileDir)).To(Succeed())
+			Expect(buffer.String()).To(ContainSubstring("The buildpack profile.d script ruby.sh has the same name as a script in your app's .profile.d"))
+		})
+
+		It("runs the app scripts after the buildpack scripts", func() {
+			Expect(compiler.InstallProfileScripts(buildpackProfileDir)).To(Succeed())
+
+			scripts, err := c.ListProfileScripts(appProfileDir)
+			Expect(err).To(BeNil())
+			Expect(scripts).To(Equal([]string{"00000001_1_000_multi-supply.sh", "00000001_1_ruby.sh", "0_early.sh", "app_ruby.sh", "ruby.sh"}))
+		})
+	})
+
+	Context("the final buildpack wrote into the app's .profile.d", func() {
+		BeforeEach(func() {
+			Expect(os.MkdirAll(appProfileDir, 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(appProfileDir, "compiled.sh"), []byte("compiled"), 0755)).To(Succeed())
+		})
+
+		It("namespaces those scripts as well", func() {
+			Expect(compiler.InstallProfileScripts(buildpackProfileDir)).To(Succeed())
+			Expect(ioutil.ReadFile(filepath.Join(appProfileDir, "00000001_1_compiled.sh"))).To(Equal([]byte("compiled")))
+		})
+	})
+
+	Context("a namespaced script already exists", func() {
+		BeforeEach(func() {
+			Expect(os.MkdirAll(appProfileDir, 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(appProfileDir, "00000001_1_ruby.sh"), []byte("app"), 0755)).To(Succeed())
+			compiler.AppProfileScripts = []string{"00000001_1_ruby.sh"}
+		})
+
+		It("returns an error instead of overwriting it", func() {
+			err = compiler.InstallProfileScripts(buildpackProfileDir)
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("collides"))
+		})
+	})
+})
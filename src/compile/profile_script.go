@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"text/template"
+)
+
+// MultiProfileScriptName runs before every other .profile.d script
+const MultiProfileScriptName = "00000000_multi.sh"
+
+// The launcher sources this script, so it must not exit or `set -e`. It is
+// sourced again by every `cf ssh` session, so each step checks whether an
+// earlier run already did it.
+var multiProfileScriptTemplate = template.Must(template.New("multi").Parse(`# Generated by the multi-buildpack
+__multi_parent=$(dirname "$HOME")
+__multi_staged="$HOME/{{.StagedDepsDir}}"
+__multi_deps="$__multi_parent/{{.DepsDir}}"
+
+if [ -d "$__multi_staged" ] && ! [ "$__multi_staged" -ef "$__multi_deps" ]; then
+  if ! [ -e "$__multi_deps" ] && ! [ -L "$__multi_deps" ]; then
+    mv "$__multi_staged" "$__multi_deps" 2>/dev/null
+  elif [ -d "$__multi_deps" ]; then
+    # move the entries one by one only if none clashes, and put back the
+    # ones moved if one fails, so that the deps always stay together
+    __multi_clash=
+    for __multi_dep in "$__multi_staged"/* "$__multi_staged"/.[!.]* "$__multi_staged"/..?*; do
+      __multi_name="${__multi_dep##*/}"
+      if { [ -e "$__multi_dep" ] || [ -L "$__multi_dep" ]; } && { [ -e "$__multi_deps/$__multi_name" ] || [ -L "$__multi_deps/$__multi_name" ]; }; then
+        __multi_clash=1
+      fi
+    done
+
+    if [ -z "$__multi_clash" ]; then
+      __multi_moved=
+      for __multi_dep in "$__multi_staged"/* "$__multi_staged"/.[!.]* "$__multi_staged"/..?*; do
+        if [ -e "$__multi_dep" ] || [ -L "$__multi_dep" ]; then
+          if ! mv "$__multi_dep" "$__multi_deps/" 2>/dev/null; then
+            printf '%s\n' "$__multi_moved" | while IFS= read -r __multi_name; do
+              if [ -n "$__multi_name" ]; then
+                mv "$__multi_deps/$__multi_name" "$__multi_staged/" 2>/dev/null
+              fi
+            done
+            break
+          fi
+          __multi_moved="$__multi_moved
+${__multi_dep##*/}"
+        fi
+      done
+      rmdir "$__multi_staged" 2>/dev/null
+    fi
+  fi
+
+  if [ -d "$__multi_staged" ] && ! [ -e "$__multi_deps" ] && ! [ -L "$__multi_deps" ]; then
+    ln -s "$__multi_staged" "$__multi_deps" 2>/dev/null
+  fi
+fi
+
+if [ -d "$__multi_staged" ] && ! [ "$__multi_staged" -ef "$__multi_deps" ]; then
+  echo "multi-buildpack: unable to move $__multi_staged to $__multi_deps, using it in place" >&2
+  export DEPS_DIR="$__multi_staged"
+else
+  export DEPS_DIR="$__multi_deps"
+fi
+
+unset __multi_parent __multi_staged __multi_deps __multi_dep __multi_name __multi_clash __multi_moved
+`))
+
+// MultiProfileScript returns the .profile.d script that moves the deps from
+// the droplet's app dir to where the buildpacks expect them at launch, and
+// exports DEPS_DIR
+func MultiProfileScript() (string, error) {
+	var script bytes.Buffer
+	err := multiProfileScriptTemplate.Execute(&script, struct {
+		StagedDepsDir string
+		DepsDir       string
+	}{
+		StagedDepsDir: ".deps",
+		DepsDir:       "deps",
+	})
+	return script.String(), err
+}
+
+// WriteMultiProfileScript writes the MultiProfileScript into profileDir
+func WriteMultiProfileScript(profileDir string) error {
+	script, err := MultiProfileScript()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(profileDir, 0755); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(profileDir, MultiProfileScriptName), []byte(script), 0755)
+}
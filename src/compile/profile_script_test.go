@@ -0,0 +1,174 @@
+package main_test
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	c "compile"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("MultiProfileScript", func() {
+	var (
+		err        error
+		sandboxDir string
+		homeDir    string
+		profileDir string
+		path       string
+	)
+
+	source := func() string {
+		cmd := exec.Command("bash", "-c", `cd "$HOME" && source .profile.d/`+c.MultiProfileScriptName+` && echo "$DEPS_DIR"`)
+		cmd.Env = append(os.Environ(), "HOME="+homeDir, "PATH="+path)
+		output, err := cmd.Output()
+		Expect(err).To(BeNil())
+		return strings.TrimSpace(string(output))
+	}
+
+	BeforeEach(func() {
+		sandboxDir, err = ioutil.TempDir("", "sandbox")
+		Expect(err).To(BeNil())
+
+		homeDir = filepath.Join(sandboxDir, "app")
+		profileDir = filepath.Join(homeDir, ".profile.d")
+		Expect(c.WriteMultiProfileScript(profileDir)).To(Succeed())
+
+		Expect(os.MkdirAll(filepath.Join(homeDir, ".deps", "0", "bin"), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(homeDir, ".deps", "0", "bin", "ruby"), []byte("ruby"), 0755)).To(Succeed())
+
+		path = os.Getenv("PATH")
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(sandboxDir)).To(Succeed())
+	})
+
+	It("moves .deps next to the app dir and exports DEPS_DIR", func() {
+		Expect(source()).To(Equal(filepath.Join(sandboxDir, "deps")))
+
+		Expect(filepath.Join(homeDir, ".deps")).NotTo(BeADirectory())
+		Expect(ioutil.ReadFile(filepath.Join(sandboxDir, "deps", "0", "bin", "ruby"))).To(Equal([]byte("ruby")))
+	})
+
+	It("is idempotent", func() {
+		Expect(source()).To(Equal(filepath.Join(sandboxDir, "deps")))
+		Expect(source()).To(Equal(filepath.Join(sandboxDir, "deps")))
+
+		Expect(ioutil.ReadFile(filepath.Join(sandboxDir, "deps", "0", "bin", "ruby"))).To(Equal([]byte("ruby")))
+	})
+
+	It("does not stop the shell sourcing it on errors", func() {
+		Expect(os.RemoveAll(filepath.Join(homeDir, ".deps"))).To(Succeed())
+
+		cmd := exec.Command("bash", "-c", `cd "$HOME" && source .profile.d/`+c.MultiProfileScriptName+`; false; echo still running`)
+		cmd.Env = append(os.Environ(), "HOME="+homeDir)
+		output, err := cmd.Output()
+		Expect(err).To(BeNil())
+		Expect(string(output)).To(ContainSubstring("still running"))
+	})
+
+	Context(".deps is empty", func() {
+		BeforeEach(func() {
+			Expect(os.RemoveAll(filepath.Join(homeDir, ".deps", "0"))).To(Succeed())
+		})
+
+		It("still exports DEPS_DIR", func() {
+			Expect(source()).To(Equal(filepath.Join(sandboxDir, "deps")))
+			Expect(filepath.Join(sandboxDir, "deps")).To(BeADirectory())
+		})
+	})
+
+	Context("the deps dir already exists", func() {
+		BeforeEach(func() {
+			Expect(os.MkdirAll(filepath.Join(sandboxDir, "deps"), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(homeDir, ".deps", ".hidden"), []byte("hidden"), 0644)).To(Succeed())
+		})
+
+		It("moves every entry, including dotfiles, into it", func() {
+			Expect(source()).To(Equal(filepath.Join(sandboxDir, "deps")))
+
+			Expect(filepath.Join(homeDir, ".deps")).NotTo(BeADirectory())
+			Expect(ioutil.ReadFile(filepath.Join(sandboxDir, "deps", "0", "bin", "ruby"))).To(Equal([]byte("ruby")))
+			Expect(ioutil.ReadFile(filepath.Join(sandboxDir, "deps", ".hidden"))).To(Equal([]byte("hidden")))
+		})
+
+		Context("an entry clashes with one in the deps dir", func() {
+			BeforeEach(func() {
+				Expect(os.MkdirAll(filepath.Join(homeDir, ".deps", "1"), 0755)).To(Succeed())
+				Expect(os.MkdirAll(filepath.Join(sandboxDir, "deps", "0"), 0755)).To(Succeed())
+				Expect(ioutil.WriteFile(filepath.Join(sandboxDir, "deps", "0", "other"), []byte("other"), 0644)).To(Succeed())
+			})
+
+			It("moves nothing and uses .deps in place", func() {
+				Expect(source()).To(Equal(filepath.Join(homeDir, ".deps")))
+
+				Expect(ioutil.ReadFile(filepath.Join(homeDir, ".deps", "0", "bin", "ruby"))).To(Equal([]byte("ruby")))
+				Expect(filepath.Join(homeDir, ".deps", "1")).To(BeADirectory())
+				Expect(filepath.Join(homeDir, ".deps", ".hidden")).To(BeAnExistingFile())
+				Expect(filepath.Join(sandboxDir, "deps", "1")).NotTo(BeADirectory())
+				Expect(filepath.Join(sandboxDir, "deps", "0", "bin")).NotTo(BeADirectory())
+			})
+		})
+
+		Context("moving an entry fails", func() {
+			BeforeEach(func() {
+				Expect(os.MkdirAll(filepath.Join(homeDir, ".deps", "1"), 0755)).To(Succeed())
+
+				mv, err := exec.LookPath("mv")
+				Expect(err).To(BeNil())
+				binDir := filepath.Join(sandboxDir, "bin")
+				Expect(os.MkdirAll(binDir, 0755)).To(Succeed())
+				Expect(ioutil.WriteFile(filepath.Join(binDir, "mv"), []byte("#!/bin/sh\ncase \"$1\" in */.deps/1) exit 1;; esac\nexec "+mv+" \"$@\"\n"), 0755)).To(Succeed())
+				path = binDir + ":" + path
+			})
+
+			It("puts back the entries already moved and uses .deps in place", func() {
+				Expect(source()).To(Equal(filepath.Join(homeDir, ".deps")))
+
+				Expect(ioutil.ReadFile(filepath.Join(homeDir, ".deps", "0", "bin", "ruby"))).To(Equal([]byte("ruby")))
+				Expect(filepath.Join(homeDir, ".deps", "1")).To(BeADirectory())
+				Expect(filepath.Join(homeDir, ".deps", ".hidden")).To(BeAnExistingFile())
+				Expect(filepath.Join(sandboxDir, "deps", "0")).NotTo(BeADirectory())
+			})
+		})
+	})
+
+	Context("the deps can not be moved", func() {
+		BeforeEach(func() {
+			binDir := filepath.Join(sandboxDir, "bin")
+			Expect(os.MkdirAll(binDir, 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(binDir, "mv"), []byte("#!/bin/sh\nexit 1\n"), 0755)).To(Succeed())
+			path = binDir + ":" + path
+		})
+
+		It("symlinks the deps dir to .deps", func() {
+			Expect(source()).To(Equal(filepath.Join(sandboxDir, "deps")))
+
+			target, err := os.Readlink(filepath.Join(sandboxDir, "deps"))
+			Expect(err).To(BeNil())
+			Expect(target).To(Equal(filepath.Join(homeDir, ".deps")))
+		})
+
+		It("is idempotent", func() {
+			Expect(source()).To(Equal(filepath.Join(sandboxDir, "deps")))
+			Expect(source()).To(Equal(filepath.Join(sandboxDir, "deps")))
+			Expect(ioutil.ReadFile(filepath.Join(sandboxDir, "deps", "0", "bin", "ruby"))).To(Equal([]byte("ruby")))
+		})
+	})
+
+	Context("the deps dir is unusable", func() {
+		BeforeEach(func() {
+			Expect(ioutil.WriteFile(filepath.Join(sandboxDir, "deps"), []byte("not a dir"), 0444)).To(Succeed())
+		})
+
+		It("uses .deps in place", func() {
+			Expect(source()).To(Equal(filepath.Join(homeDir, ".deps")))
+			Expect(ioutil.ReadFile(filepath.Join(homeDir, ".deps", "0", "bin", "ruby"))).To(Equal([]byte("ruby")))
+		})
+	})
+})
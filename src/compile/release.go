@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/cloudfoundry/libbuildpack"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// ReleaseFile holds the release compile generated for bin/release, relative
+// to the build dir
+var ReleaseFile = filepath.Join(".multi-buildpack", "release.yml")
+
+// BuildpackRelease is the output of a buildpack's bin/release. Unlike
+// buildpackrunner.Release it keeps the legacy addons and config_vars.
+type BuildpackRelease struct {
+	Addons              []string          `yaml:"addons,omitempty"`
+	ConfigVars          map[string]string `yaml:"config_vars,omitempty"`
+	DefaultProcessTypes map[string]string `yaml:"default_process_types"`
+}
+
+// MultiBuildpackRelease is the release bin/release prints, along with the
+// build dir of the staging that generated it
+type MultiBuildpackRelease struct {
+	BuildDir         string `yaml:"build_dir"`
+	BuildpackRelease `yaml:",inline"`
+}
+
+// RemoveRelease removes the release left by an earlier staging so that a
+// failed compile cannot release it
+func RemoveRelease(buildDir string) error {
+	if err := os.Remove(filepath.Join(buildDir, ReleaseFile)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// ReadRelease returns the release compile generated for buildDir
+func ReadRelease(buildDir string) (BuildpackRelease, error) {
+	releaseFile := filepath.Join(buildDir, ReleaseFile)
+
+	var release MultiBuildpackRelease
+	if err := libbuildpack.NewYAML().Load(releaseFile, &release); err != nil {
+		if os.IsNotExist(err) {
+			return BuildpackRelease{}, fmt.Errorf("%s does not exist; the multi-buildpack compile step did not finish", releaseFile)
+		}
+		return BuildpackRelease{}, fmt.Errorf("%s is malformed: %s", releaseFile, err.Error())
+	}
+
+	if absBuildDir, err := filepath.Abs(buildDir); err != nil {
+		return BuildpackRelease{}, err
+	} else if release.BuildDir != absBuildDir {
+		return BuildpackRelease{}, fmt.Errorf("%s is stale; it was generated for %s, not %s", releaseFile, release.BuildDir, absBuildDir)
+	}
+
+	if release.DefaultProcessTypes == nil {
+		return BuildpackRelease{}, fmt.Errorf("%s has no default_process_types", releaseFile)
+	}
+
+	return release.BuildpackRelease, nil
+}
+
+// Release prints the release for buildDir, as bin/release <build-dir>
+func Release(buildDir string, out io.Writer) error {
+	release, err := ReadRelease(buildDir)
+	if err != nil {
+		return err
+	}
+
+	data, err := yaml.Marshal(&release)
+	if err != nil {
+		return err
+	}
+
+	_, err = out.Write(data)
+	return err
+}
@@ -0,0 +1,103 @@
+package main_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	c "compile"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Release", func() {
+	var (
+		err      error
+		buildDir string
+		output   *bytes.Buffer
+	)
+
+	writeRelease := func(contents string) {
+		Expect(os.MkdirAll(filepath.Join(buildDir, ".multi-buildpack"), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(buildDir, c.ReleaseFile), []byte(contents), 0644)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		buildDir, err = ioutil.TempDir("", "build")
+		Expect(err).To(BeNil())
+
+		output = new(bytes.Buffer)
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(buildDir)).To(Succeed())
+	})
+
+	Context("compile wrote the release for this build dir", func() {
+		BeforeEach(func() {
+			writeRelease("build_dir: " + buildDir + "\ndefault_process_types:\n  web: ./start\n  worker: ./work\n")
+		})
+
+		It("prints the release", func() {
+			Expect(c.Release(buildDir, output)).To(Succeed())
+			Expect(output.String()).To(Equal("default_process_types:\n  web: ./start\n  worker: ./work\n"))
+		})
+	})
+
+	Context("the release has addons and config_vars", func() {
+		BeforeEach(func() {
+			writeRelease("build_dir: " + buildDir + "\naddons:\n- heroku-postgresql:dev\nconfig_vars:\n  RACK_ENV: production\ndefault_process_types:\n  web: ./start\n")
+		})
+
+		It("prints them", func() {
+			Expect(c.Release(buildDir, output)).To(Succeed())
+			Expect(output.String()).To(Equal("addons:\n- heroku-postgresql:dev\nconfig_vars:\n  RACK_ENV: production\ndefault_process_types:\n  web: ./start\n"))
+		})
+	})
+
+	Context("the release does not exist", func() {
+		It("returns an error", func() {
+			err = c.Release(buildDir, output)
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("the multi-buildpack compile step did not finish"))
+			Expect(output.String()).To(Equal(""))
+		})
+	})
+
+	Context("the release was written for another build dir", func() {
+		BeforeEach(func() {
+			writeRelease("build_dir: /tmp/other\ndefault_process_types:\n  web: ./start\n")
+		})
+
+		It("returns an error", func() {
+			err = c.Release(buildDir, output)
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("is stale; it was generated for /tmp/other"))
+			Expect(output.String()).To(Equal(""))
+		})
+	})
+
+	Context("the release has no process types", func() {
+		BeforeEach(func() {
+			writeRelease("build_dir: " + buildDir + "\n")
+		})
+
+		It("returns an error", func() {
+			err = c.Release(buildDir, output)
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("has no default_process_types"))
+		})
+	})
+
+	Describe("RemoveRelease", func() {
+		It("removes the release of an earlier staging", func() {
+			writeRelease("build_dir: " + buildDir + "\ndefault_process_types:\n  web: ./start\n")
+
+			Expect(c.RemoveRelease(buildDir)).To(Succeed())
+			Expect(filepath.Join(buildDir, c.ReleaseFile)).NotTo(BeAnExistingFile())
+			Expect(c.RemoveRelease(buildDir)).To(Succeed())
+		})
+	})
+})
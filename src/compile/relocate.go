@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cloudfoundry/libbuildpack"
+)
+
+// RuntimeDepsDir is where the deps usually end up once the app is running.
+// The profile script may pick another DEPS_DIR, so files rewritten to point
+// at it are reported.
+const RuntimeDepsDir = "/home/vcap/deps"
+
+type depsRelocator struct {
+	depsDir        string
+	stagingDepsDir string
+	log            *libbuildpack.Logger
+	unfixed        []string
+	hardcoded      []string
+}
+
+// RelocateDeps rewrites references to the deps dir the buildpacks were staged
+// into (e.g. /tmp/contents123/deps) inside the relocated deps tree. Symlinks
+// become relative, shell scripts sourced at launch use $DEPS_DIR, .pc files
+// use ${pcfiledir} and all other text files point at RuntimeDepsDir.
+func RelocateDeps(depsDir, stagingDepsDir string, logger *libbuildpack.Logger) error {
+	r := &depsRelocator{
+		depsDir:        depsDir,
+		stagingDepsDir: filepath.Clean(stagingDepsDir),
+		log:            logger,
+	}
+
+	err := filepath.Walk(depsDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			return r.relocateSymlink(path)
+		}
+		if info.Mode().IsRegular() {
+			return r.relocateFile(path, isProfileScript(depsDir, path))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	r.report()
+	return nil
+}
+
+// RelocateProfileScripts rewrites references to the staging deps dir inside
+// the scripts in profileDir to use $DEPS_DIR
+func RelocateProfileScripts(profileDir, stagingDepsDir string, logger *libbuildpack.Logger) error {
+	r := &depsRelocator{
+		stagingDepsDir: filepath.Clean(stagingDepsDir),
+		log:            logger,
+	}
+
+	scripts, err := ListProfileScripts(profileDir)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range scripts {
+		path := filepath.Join(profileDir, name)
+		info, err := os.Lstat(path)
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			if err := r.relocateFile(path, true); err != nil {
+				return err
+			}
+		}
+	}
+
+	r.report()
+	return nil
+}
+
+func (r *depsRelocator) relocateSymlink(path string) error {
+	target, err := os.Readlink(path)
+	if err != nil {
+		return err
+	}
+
+	rest, ok := r.trimStagingDepsDir(target)
+	if !ok {
+		return nil
+	}
+
+	newTarget, err := filepath.Rel(filepath.Dir(path), filepath.Join(r.depsDir, rest))
+	if err != nil {
+		r.unfixed = append(r.unfixed, path)
+		return nil
+	}
+
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	return os.Symlink(newTarget, path)
+}
+
+func (r *depsRelocator) relocateFile(path string, shell bool) error {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		r.log.Debug("Unable to read %s: %s", path, err.Error())
+		r.unfixed = append(r.unfixed, path)
+		return nil
+	}
+
+	if !bytes.Contains(contents, []byte(r.stagingDepsDir)) {
+		return nil
+	}
+
+	// paths compiled into binaries can't be rewritten without changing
+	// their length
+	if bytes.IndexByte(contents, 0) != -1 {
+		r.unfixed = append(r.unfixed, path)
+		return nil
+	}
+
+	replacement, hardcoded := r.replacement(path, shell)
+
+	r.log.Debug("Rewriting staging paths in %s", path)
+
+	contents = bytes.Replace(contents, []byte(r.stagingDepsDir), []byte(replacement), -1)
+	if err := writeKeepingMode(path, contents); err != nil {
+		r.log.Debug("Unable to rewrite %s: %s", path, err.Error())
+		r.unfixed = append(r.unfixed, path)
+		return nil
+	}
+
+	if hardcoded {
+		r.hardcoded = append(r.hardcoded, path)
+	}
+	return nil
+}
+
+// replacement returns what the staging deps dir becomes in path, and whether
+// that is the hard-coded RuntimeDepsDir
+func (r *depsRelocator) replacement(path string, shell bool) (string, bool) {
+	if shell {
+		return "$DEPS_DIR", false
+	}
+
+	if filepath.Ext(path) == ".pc" {
+		if rel, err := filepath.Rel(filepath.Dir(path), r.depsDir); err == nil {
+			return "${pcfiledir}/" + filepath.ToSlash(rel), false
+		}
+	}
+
+	return RuntimeDepsDir, true
+}
+
+// writeKeepingMode overwrites the file at path, adding the owner write bit
+// while it does if the file is read-only
+func writeKeepingMode(path string, contents []byte) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	mode := info.Mode().Perm()
+	if mode&0200 != 0 {
+		return ioutil.WriteFile(path, contents, 0)
+	}
+
+	if err := os.Chmod(path, mode|0200); err != nil {
+		return err
+	}
+	writeErr := ioutil.WriteFile(path, contents, 0)
+	if err := os.Chmod(path, mode); err != nil && writeErr == nil {
+		return err
+	}
+	return writeErr
+}
+
+func (r *depsRelocator) trimStagingDepsDir(path string) (string, bool) {
+	if path == r.stagingDepsDir {
+		return "", true
+	}
+	if strings.HasPrefix(path, r.stagingDepsDir+string(filepath.Separator)) {
+		return strings.TrimPrefix(path, r.stagingDepsDir), true
+	}
+	return "", false
+}
+
+func (r *depsRelocator) report() {
+	if len(r.unfixed) > 0 {
+		r.log.Warning("Unable to rewrite the staging path %s in the following files; they may not work at runtime:\n%s", r.stagingDepsDir, strings.Join(r.unfixed, "\n"))
+	}
+	if len(r.hardcoded) > 0 {
+		r.log.Warning("Rewrote the staging path %s to %s in the following files; they may not work if the deps are elsewhere at runtime:\n%s", r.stagingDepsDir, RuntimeDepsDir, strings.Join(r.hardcoded, "\n"))
+	}
+}
+
+// scripts in deps/<idx>/profile.d are sourced at launch, when DEPS_DIR is set
+func isProfileScript(depsDir, path string) bool {
+	rel, err := filepath.Rel(depsDir, path)
+	if err != nil {
+		return false
+	}
+
+	parts := strings.Split(rel, string(filepath.Separator))
+	return len(parts) == 3 && parts[1] == "profile.d"
+}
@@ -0,0 +1,159 @@
+package main_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	c "compile"
+
+	"github.com/cloudfoundry/libbuildpack"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Relocate", func() {
+	var (
+		err            error
+		depsDir        string
+		stagingDepsDir string
+		buffer         *bytes.Buffer
+		logger         *libbuildpack.Logger
+	)
+
+	BeforeEach(func() {
+		depsDir, err = ioutil.TempDir("", "deps")
+		Expect(err).To(BeNil())
+
+		stagingDepsDir = "/tmp/contents123/deps"
+
+		buffer = new(bytes.Buffer)
+		logger = libbuildpack.NewLogger(buffer)
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(depsDir)).To(Succeed())
+	})
+
+	Describe("RelocateDeps", func() {
+		BeforeEach(func() {
+			for _, dir := range []string{"env", "bin", "lib/pkgconfig", "profile.d"} {
+				Expect(os.MkdirAll(filepath.Join(depsDir, "0", dir), 0755)).To(Succeed())
+			}
+
+			Expect(ioutil.WriteFile(filepath.Join(depsDir, "0", "env", "PYTHONHOME"), []byte("/tmp/contents123/deps/0/python"), 0644)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(depsDir, "0", "config.yml"), []byte("name: python\nhome: /tmp/contents123/deps/0\n"), 0644)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(depsDir, "0", "bin", "pip"), []byte("#!/tmp/contents123/deps/0/bin/python\nimport pip\n"), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(depsDir, "0", "lib", "pkgconfig", "python.pc"), []byte("prefix=/tmp/contents123/deps/0\n"), 0644)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(depsDir, "0", "profile.d", "python.sh"), []byte("export PYTHONHOME=/tmp/contents123/deps/0/python\n"), 0755)).To(Succeed())
+			Expect(os.Symlink("/tmp/contents123/deps/0/bin/pip", filepath.Join(depsDir, "0", "pip"))).To(Succeed())
+			Expect(os.Symlink("/usr/bin/env", filepath.Join(depsDir, "0", "bin", "env"))).To(Succeed())
+		})
+
+		It("points env files, config.yml and shebangs at the runtime deps dir", func() {
+			Expect(c.RelocateDeps(depsDir, stagingDepsDir, logger)).To(Succeed())
+
+			Expect(ioutil.ReadFile(filepath.Join(depsDir, "0", "env", "PYTHONHOME"))).To(Equal([]byte("/home/vcap/deps/0/python")))
+			Expect(ioutil.ReadFile(filepath.Join(depsDir, "0", "config.yml"))).To(Equal([]byte("name: python\nhome: /home/vcap/deps/0\n")))
+			Expect(ioutil.ReadFile(filepath.Join(depsDir, "0", "bin", "pip"))).To(Equal([]byte("#!/home/vcap/deps/0/bin/python\nimport pip\n")))
+		})
+
+		It("reports the files pointed at the runtime deps dir", func() {
+			Expect(c.RelocateDeps(depsDir, stagingDepsDir, logger)).To(Succeed())
+
+			Expect(buffer.String()).To(ContainSubstring("Rewrote the staging path /tmp/contents123/deps to /home/vcap/deps in the following files"))
+			Expect(buffer.String()).To(ContainSubstring(filepath.Join(depsDir, "0", "bin", "pip")))
+			Expect(buffer.String()).NotTo(ContainSubstring("python.pc"))
+			Expect(buffer.String()).NotTo(ContainSubstring("python.sh"))
+		})
+
+		It("makes .pc files relative to ${pcfiledir}", func() {
+			Expect(c.RelocateDeps(depsDir, stagingDepsDir, logger)).To(Succeed())
+
+			Expect(ioutil.ReadFile(filepath.Join(depsDir, "0", "lib", "pkgconfig", "python.pc"))).To(Equal([]byte("prefix=${pcfiledir}/../../../0\n")))
+		})
+
+		It("uses $DEPS_DIR in profile.d scripts", func() {
+			Expect(c.RelocateDeps(depsDir, stagingDepsDir, logger)).To(Succeed())
+
+			Expect(ioutil.ReadFile(filepath.Join(depsDir, "0", "profile.d", "python.sh"))).To(Equal([]byte("export PYTHONHOME=$DEPS_DIR/0/python\n")))
+		})
+
+		It("preserves file permissions", func() {
+			Expect(c.RelocateDeps(depsDir, stagingDepsDir, logger)).To(Succeed())
+
+			info, err := os.Stat(filepath.Join(depsDir, "0", "bin", "pip"))
+			Expect(err).To(BeNil())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0755)))
+		})
+
+		Context("a script is read-only", func() {
+			BeforeEach(func() {
+				Expect(ioutil.WriteFile(filepath.Join(depsDir, "0", "bin", "tool"), []byte("#!/tmp/contents123/deps/0/bin/python\n"), 0555)).To(Succeed())
+			})
+
+			It("rewrites it and restores its mode", func() {
+				Expect(c.RelocateDeps(depsDir, stagingDepsDir, logger)).To(Succeed())
+
+				Expect(ioutil.ReadFile(filepath.Join(depsDir, "0", "bin", "tool"))).To(Equal([]byte("#!/home/vcap/deps/0/bin/python\n")))
+				info, err := os.Stat(filepath.Join(depsDir, "0", "bin", "tool"))
+				Expect(err).To(BeNil())
+				Expect(info.Mode().Perm()).To(Equal(os.FileMode(0555)))
+			})
+		})
+
+		It("makes symlinks into the deps dir relative", func() {
+			Expect(c.RelocateDeps(depsDir, stagingDepsDir, logger)).To(Succeed())
+
+			target, err := os.Readlink(filepath.Join(depsDir, "0", "pip"))
+			Expect(err).To(BeNil())
+			Expect(target).To(Equal("bin/pip"))
+
+			target, err = os.Readlink(filepath.Join(depsDir, "0", "bin", "env"))
+			Expect(err).To(BeNil())
+			Expect(target).To(Equal("/usr/bin/env"))
+		})
+
+		Context("a binary file references the staging deps dir", func() {
+			BeforeEach(func() {
+				Expect(ioutil.WriteFile(filepath.Join(depsDir, "0", "bin", "python"), []byte("\x7fELF\x00/tmp/contents123/deps/0/lib\x00"), 0755)).To(Succeed())
+			})
+
+			It("leaves the file alone", func() {
+				Expect(c.RelocateDeps(depsDir, stagingDepsDir, logger)).To(Succeed())
+				Expect(ioutil.ReadFile(filepath.Join(depsDir, "0", "bin", "python"))).To(Equal([]byte("\x7fELF\x00/tmp/contents123/deps/0/lib\x00")))
+			})
+
+			It("reports the file", func() {
+				Expect(c.RelocateDeps(depsDir, stagingDepsDir, logger)).To(Succeed())
+				Expect(buffer.String()).To(ContainSubstring("Unable to rewrite the staging path /tmp/contents123/deps"))
+				Expect(buffer.String()).To(ContainSubstring(filepath.Join(depsDir, "0", "bin", "python")))
+			})
+		})
+
+		Context("nothing references the staging deps dir", func() {
+			BeforeEach(func() {
+				Expect(os.RemoveAll(filepath.Join(depsDir, "0"))).To(Succeed())
+				Expect(os.MkdirAll(filepath.Join(depsDir, "0"), 0755)).To(Succeed())
+				Expect(ioutil.WriteFile(filepath.Join(depsDir, "0", "config.yml"), []byte("name: python\n"), 0644)).To(Succeed())
+			})
+
+			It("reports nothing", func() {
+				Expect(c.RelocateDeps(depsDir, stagingDepsDir, logger)).To(Succeed())
+				Expect(buffer.String()).To(Equal(""))
+			})
+		})
+	})
+
+	Describe("RelocateProfileScripts", func() {
+		BeforeEach(func() {
+			Expect(ioutil.WriteFile(filepath.Join(depsDir, "000_multi-supply.sh"), []byte("export PATH=/tmp/contents123/deps/1/bin:$PATH\n"), 0755)).To(Succeed())
+		})
+
+		It("uses $DEPS_DIR in the scripts", func() {
+			Expect(c.RelocateProfileScripts(depsDir, stagingDepsDir, logger)).To(Succeed())
+			Expect(ioutil.ReadFile(filepath.Join(depsDir, "000_multi-supply.sh"))).To(Equal([]byte("export PATH=$DEPS_DIR/1/bin:$PATH\n")))
+		})
+	})
+})
@@ -0,0 +1,601 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+
+	"code.cloudfoundry.org/buildpackapplifecycle"
+	"code.cloudfoundry.org/buildpackapplifecycle/buildpackrunner"
+	"code.cloudfoundry.org/bytefmt"
+	"github.com/cloudfoundry/libbuildpack"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// BuildpackRunner runs the supply, finalize and release steps of a list of
+// buildpacks. Unlike buildpackrunner.Runner it does not copy the app or tar up
+// the droplet and build artifacts cache, since the lifecycle staging the
+// multi-buildpack does that once compile has finished.
+type BuildpackRunner struct {
+	// StartFrom picks the buildpack whose bin/release gives the process
+	// types, by index, URL or name; the final buildpack if empty
+	StartFrom string
+	// Processes overrides the process types given by the buildpack and the
+	// Procfile
+	Processes map[string]string
+	// MergeConfigVars merges the config_vars from the release of every
+	// buildpack, not just the one giving the process types
+	MergeConfigVars bool
+	// Optional are the indexes of the buildpacks that are skipped, rather
+	// than failing staging, when they cannot be downloaded, are invalid or
+	// their supply fails
+	Optional []int
+	// Decorators are run after the final buildpack, and may wrap the
+	// commands of the process types
+	Decorators []string
+
+	config      *buildpackapplifecycle.LifecycleBuilderConfig
+	cache       *BuildpackCache
+	log         *libbuildpack.Logger
+	contentsDir string
+	depsDir     string
+	profileDir  string
+	skipped     map[int]bool
+	// the command prefixes given by the decorators
+	commandPrefixes []string
+}
+
+// NewBuildpackRunner creates a new BuildpackRunner
+func NewBuildpackRunner(config *buildpackapplifecycle.LifecycleBuilderConfig, cache *BuildpackCache, logger *libbuildpack.Logger) *BuildpackRunner {
+	return &BuildpackRunner{
+		config:  config,
+		cache:   cache,
+		log:     logger,
+		skipped: map[int]bool{},
+	}
+}
+
+// Run runs the buildpacks and returns the location of staging_info.yml
+func (r *BuildpackRunner) Run() (string, error) {
+	if err := r.makeDirectories(); err != nil {
+		return "", fmt.Errorf("Failed to set up filesystem when generating droplet: %s", err.Error())
+	}
+
+	buildpackPaths, err := r.setup()
+	if err != nil {
+		return "", err
+	}
+
+	if err := r.runSupplyBuildpacks(buildpackPaths); err != nil {
+		return "", err
+	}
+
+	if err := r.runFinalize(buildpackPaths[len(buildpackPaths)-1], true); err != nil {
+		return "", err
+	}
+
+	if r.commandPrefixes, err = r.runDecorators(); err != nil {
+		return "", err
+	}
+
+	return r.finish(buildpackPaths)
+}
+
+// Supply runs the supply step of every buildpack, including the final one,
+// with depsDir as their deps dir. It is the first half of Run, for when the
+// multi-buildpack is itself run as a supply buildpack.
+func (r *BuildpackRunner) Supply(depsDir string) error {
+	r.depsDir = depsDir
+	if err := r.makeDepsDirectories(); err != nil {
+		return fmt.Errorf("Failed to set up filesystem when generating droplet: %s", err.Error())
+	}
+
+	buildpackPaths, err := r.setup()
+	if err != nil {
+		return err
+	}
+
+	if err := r.runSupplyBuildpacks(buildpackPaths); err != nil {
+		return err
+	}
+
+	finalPath := buildpackPaths[len(buildpackPaths)-1]
+	if hasSupply, err := libbuildpack.FileExists(filepath.Join(finalPath, "bin", "supply")); err != nil {
+		return fmt.Errorf("%s: %s", buildpackapplifecycle.SupplyFailMsg, err.Error())
+	} else if hasSupply {
+		if err := r.runFinalSupply(finalPath); err != nil {
+			return err
+		}
+	}
+
+	return r.cache.Finish()
+}
+
+// Finalize runs the finalize step of the final buildpack after Supply, and
+// returns the location of staging_info.yml
+func (r *BuildpackRunner) Finalize(depsDir, profileDir string) (string, error) {
+	var err error
+	r.contentsDir, err = ioutil.TempDir("", "release")
+	if err != nil {
+		return "", fmt.Errorf("Failed to set up filesystem when generating droplet: %s", err.Error())
+	}
+	r.depsDir = depsDir
+	r.profileDir = profileDir
+	if err := os.MkdirAll(r.profileDir, 0755); err != nil {
+		return "", fmt.Errorf("Failed to set up filesystem when generating droplet: %s", err.Error())
+	}
+
+	buildpackPaths, err := r.setup()
+	if err != nil {
+		return "", err
+	}
+
+	if err := r.runFinalize(buildpackPaths[len(buildpackPaths)-1], false); err != nil {
+		return "", err
+	}
+
+	if r.commandPrefixes, err = r.runDecorators(); err != nil {
+		return "", err
+	}
+
+	return r.finish(buildpackPaths)
+}
+
+// setup downloads the buildpacks and their build caches, and returns their
+// paths
+func (r *BuildpackRunner) setup() ([]string, error) {
+	if err := r.downloadBuildpacks(); err != nil {
+		return nil, err
+	}
+
+	buildpackPaths, err := r.buildpackPaths()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.cache.Setup(r.config.BuildpackOrder(), buildpackPaths); err != nil {
+		return nil, fmt.Errorf("Failed to set up build cache: %s", err.Error())
+	}
+
+	return buildpackPaths, nil
+}
+
+// finish writes staging_info.yml from the release once the buildpacks have
+// run
+func (r *BuildpackRunner) finish(buildpackPaths []string) (string, error) {
+	startCommands, err := r.readProcfile()
+	if err != nil {
+		return "", fmt.Errorf("Failed to read command from Procfile: %s", err.Error())
+	}
+
+	releasePath, err := r.releaseBuildpackPath(buildpackPaths)
+	if err != nil {
+		return "", err
+	}
+
+	release, err := r.release(releasePath, startCommands)
+	if err != nil {
+		return "", fmt.Errorf("%s: %s", buildpackapplifecycle.ReleaseFailMsg, err.Error())
+	}
+	release.DefaultProcessTypes = WrapProcessTypes(MergeProcessTypes(release.DefaultProcessTypes, r.Processes), r.commandPrefixes)
+	if r.MergeConfigVars {
+		release.ConfigVars = r.mergeConfigVars(buildpackPaths, releasePath, release.ConfigVars)
+	}
+
+	if release.DefaultProcessTypes["web"] == "" {
+		r.log.Warning("No start command specified by buildpack or via Procfile.\nApp will not start unless a command is provided at runtime.")
+	}
+
+	infoFilePath := filepath.Join(r.contentsDir, "staging_info.yml")
+	if err := r.saveInfo(infoFilePath, release); err != nil {
+		return "", fmt.Errorf("Failed to encode generated metadata: %s", err.Error())
+	}
+
+	if err := r.cache.Finish(); err != nil {
+		return "", err
+	}
+
+	return infoFilePath, nil
+}
+
+func (r *BuildpackRunner) makeDirectories() error {
+	var err error
+	r.contentsDir, err = ioutil.TempDir("", "contents")
+	if err != nil {
+		return err
+	}
+
+	r.depsDir = filepath.Join(r.contentsDir, "deps")
+	if err := r.makeDepsDirectories(); err != nil {
+		return err
+	}
+
+	r.profileDir = filepath.Join(r.contentsDir, "profile.d")
+	return os.MkdirAll(r.profileDir, 0755)
+}
+
+func (r *BuildpackRunner) makeDepsDirectories() error {
+	for i := 0; i <= len(r.config.SupplyBuildpacks()); i++ {
+		if err := os.MkdirAll(filepath.Join(r.depsDir, r.config.DepsIndex(i)), 0755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *BuildpackRunner) downloadBuildpacks() error {
+	for i, buildpack := range r.config.BuildpackOrder() {
+		if err := r.downloadBuildpack(buildpack); err != nil {
+			if !r.isOptional(i) {
+				return err
+			}
+			r.skip(i, err)
+			os.RemoveAll(r.config.BuildpackPath(buildpack))
+		}
+	}
+
+	return nil
+}
+
+func (r *BuildpackRunner) downloadBuildpack(buildpack string) error {
+	buildpackURL, err := url.Parse(buildpack)
+	if err != nil {
+		return fmt.Errorf("Invalid buildpack url (%s): %s", buildpack, err.Error())
+	}
+	if !buildpackURL.IsAbs() {
+		return nil
+	}
+
+	destination := r.config.BuildpackPath(buildpack)
+	if files, err := ioutil.ReadDir(destination); err == nil && len(files) > 0 {
+		// downloaded by an earlier step of this staging
+		return nil
+	}
+
+	if buildpackrunner.IsZipFile(buildpackURL.Path) {
+		size, err := buildpackrunner.NewZipDownloader(r.config.SkipCertVerify()).DownloadAndExtract(buildpackURL, destination)
+		if err != nil {
+			return err
+		}
+		r.log.Info("Downloaded buildpack `%s` (%s)", buildpackURL.String(), bytefmt.ByteSize(size))
+		return nil
+	}
+
+	return buildpackrunner.GitClone(*buildpackURL, destination)
+}
+
+// DetectBuildpack downloads a buildpack and reports whether its bin/detect
+// passes for the build dir
+func (r *BuildpackRunner) DetectBuildpack(buildpack string) (bool, error) {
+	if err := r.downloadBuildpack(buildpack); err != nil {
+		return false, err
+	}
+
+	buildpackPath, err := r.buildpackPath(buildpack)
+	if err != nil {
+		return false, err
+	}
+
+	if exists, err := libbuildpack.FileExists(filepath.Join(buildpackPath, "bin", "detect")); err != nil || !exists {
+		return false, err
+	}
+
+	cmd := exec.Command(filepath.Join(buildpackPath, "bin", "detect"), r.config.BuildDir())
+	cmd.Stdout = ioutil.Discard
+	cmd.Stderr = os.Stderr
+	return cmd.Run() == nil, nil
+}
+
+func (r *BuildpackRunner) buildpackPath(buildpack string) (string, error) {
+	buildpackPath := r.config.BuildpackPath(buildpack)
+
+	if hasBinDirectory(buildpackPath) {
+		return buildpackPath, nil
+	}
+
+	files, err := ioutil.ReadDir(buildpackPath)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read buildpack directory '%s' for buildpack '%s'", buildpackPath, buildpack)
+	}
+
+	if len(files) == 1 {
+		nestedPath := filepath.Join(buildpackPath, files[0].Name())
+		if hasBinDirectory(nestedPath) {
+			return nestedPath, nil
+		}
+	}
+
+	return "", fmt.Errorf("malformed buildpack does not contain a /bin dir: %s", buildpack)
+}
+
+// returns the paths of the buildpacks, in order, after checking that every
+// buildpack but the last can supply dependencies
+func (r *BuildpackRunner) buildpackPaths() ([]string, error) {
+	paths := []string{}
+	for i, buildpack := range r.config.BuildpackOrder() {
+		if r.skipped[i] {
+			paths = append(paths, "")
+			continue
+		}
+
+		buildpackPath, err := r.validBuildpackPath(i, buildpack)
+		if err != nil {
+			if !r.isOptional(i) {
+				return nil, err
+			}
+			r.skip(i, err)
+		}
+
+		paths = append(paths, buildpackPath)
+	}
+	return paths, nil
+}
+
+func (r *BuildpackRunner) validBuildpackPath(i int, buildpack string) (string, error) {
+	buildpackPath, err := r.buildpackPath(buildpack)
+	if err != nil {
+		return "", fmt.Errorf("%s: %s", buildpackapplifecycle.SupplyFailMsg, err.Error())
+	}
+
+	if i < len(r.config.SupplyBuildpacks()) && !IsCNB(buildpackPath) {
+		if exists, err := libbuildpack.FileExists(filepath.Join(buildpackPath, "bin", "supply")); err != nil {
+			return "", fmt.Errorf("%s: %s", buildpackapplifecycle.SupplyFailMsg, err.Error())
+		} else if !exists {
+			return "", fmt.Errorf("%s: %s", buildpackapplifecycle.NoSupplyScriptFailMsg, buildpack)
+		}
+	}
+
+	return buildpackPath, nil
+}
+
+func (r *BuildpackRunner) runSupplyBuildpacks(buildpackPaths []string) error {
+	for i, buildpack := range r.config.SupplyBuildpacks() {
+		if r.skipped[i] {
+			continue
+		}
+
+		var err error
+		if IsCNB(buildpackPaths[i]) {
+			err = r.runCNBBuild(buildpackPaths[i], r.config.DepsIndex(i))
+		} else {
+			err = r.run(exec.Command(filepath.Join(buildpackPaths[i], "bin", "supply"), r.config.BuildDir(), r.cache.Path(buildpack), r.depsDir, r.config.DepsIndex(i)))
+		}
+		if err == nil {
+			continue
+		}
+
+		err = fmt.Errorf("%s: %s", buildpackapplifecycle.SupplyFailMsg, err.Error())
+		if !r.isOptional(i) {
+			return err
+		}
+		r.skip(i, err)
+
+		// leave the deps dir empty, as if the buildpack had supplied nothing
+		depsIdxDir := filepath.Join(r.depsDir, r.config.DepsIndex(i))
+		if err := os.RemoveAll(depsIdxDir); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(depsIdxDir, 0755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *BuildpackRunner) isOptional(i int) bool {
+	for _, optional := range r.Optional {
+		if optional == i {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *BuildpackRunner) skip(i int, err error) {
+	r.skipped[i] = true
+	r.log.Warning("Skipping optional buildpack %s: %s", r.config.BuildpackOrder()[i], err.Error())
+}
+
+// runFinalize runs the final buildpack's finalize step, after its supply step
+// if runSupply is set, or its compile step if it has no finalize
+func (r *BuildpackRunner) runFinalize(buildpackPath string, runSupply bool) error {
+	depsIdx := r.config.DepsIndex(len(r.config.SupplyBuildpacks()))
+	finalBuildpack := r.config.BuildpackOrder()[len(r.config.SupplyBuildpacks())]
+	cacheDir := r.cache.Path(finalBuildpack)
+
+	hasFinalize, err := libbuildpack.FileExists(filepath.Join(buildpackPath, "bin", "finalize"))
+	if err != nil {
+		return fmt.Errorf("%s: %s", buildpackapplifecycle.FinalizeFailMsg, err.Error())
+	}
+
+	if !hasFinalize {
+		if len(r.config.SupplyBuildpacks()) > 0 {
+			r.log.Warning(buildpackapplifecycle.MissingFinalizeWarnMsg)
+		}
+
+		// remove unused deps sub dir
+		if err := os.RemoveAll(filepath.Join(r.depsDir, depsIdx)); err != nil {
+			return fmt.Errorf("%s: %s", buildpackapplifecycle.CompileFailMsg, err.Error())
+		}
+
+		if err := r.run(exec.Command(filepath.Join(buildpackPath, "bin", "compile"), r.config.BuildDir(), cacheDir)); err != nil {
+			return fmt.Errorf("%s: %s", buildpackapplifecycle.CompileFailMsg, err.Error())
+		}
+		return nil
+	}
+
+	hasSupply, err := libbuildpack.FileExists(filepath.Join(buildpackPath, "bin", "supply"))
+	if err != nil {
+		return fmt.Errorf("%s: %s", buildpackapplifecycle.SupplyFailMsg, err.Error())
+	}
+
+	if runSupply && hasSupply {
+		if err := r.runFinalSupply(buildpackPath); err != nil {
+			return err
+		}
+	}
+
+	if err := r.run(exec.Command(filepath.Join(buildpackPath, "bin", "finalize"), r.config.BuildDir(), cacheDir, r.depsDir, depsIdx, r.profileDir)); err != nil {
+		return fmt.Errorf("%s: %s", buildpackapplifecycle.FinalizeFailMsg, err.Error())
+	}
+
+	return nil
+}
+
+func (r *BuildpackRunner) runFinalSupply(buildpackPath string) error {
+	depsIdx := r.config.DepsIndex(len(r.config.SupplyBuildpacks()))
+	finalBuildpack := r.config.BuildpackOrder()[len(r.config.SupplyBuildpacks())]
+
+	if err := r.run(exec.Command(filepath.Join(buildpackPath, "bin", "supply"), r.config.BuildDir(), r.cache.Path(finalBuildpack), r.depsDir, depsIdx)); err != nil {
+		return fmt.Errorf("%s: %s", buildpackapplifecycle.SupplyFailMsg, err.Error())
+	}
+	return nil
+}
+
+func (r *BuildpackRunner) readProcfile() (map[string]string, error) {
+	processes := map[string]string{}
+
+	procFile, err := ioutil.ReadFile(filepath.Join(r.config.BuildDir(), "Procfile"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			// Procfiles are optional
+			return processes, nil
+		}
+		return processes, err
+	}
+
+	if err := yaml.Unmarshal(procFile, &processes); err != nil {
+		// clobber yaml parsing error
+		return processes, errors.New("invalid YAML")
+	}
+
+	return processes, nil
+}
+
+// releaseBuildpackPath returns the path of the buildpack named by StartFrom,
+// or of the final buildpack
+func (r *BuildpackRunner) releaseBuildpackPath(buildpackPaths []string) (string, error) {
+	if r.StartFrom == "" {
+		return buildpackPaths[len(buildpackPaths)-1], nil
+	}
+
+	buildpacks := r.config.BuildpackOrder()
+	for i, buildpack := range buildpacks {
+		if r.StartFrom == strconv.Itoa(i) || r.StartFrom == buildpack || (r.cache.Key(i) != "" && cacheKeyFromName(r.StartFrom) == r.cache.Key(i)) {
+			if r.skipped[i] {
+				return "", fmt.Errorf("start_from %s names the skipped buildpack %s", r.StartFrom, buildpack)
+			}
+			r.log.Info("Using the start command from %s", buildpack)
+			return buildpackPaths[i], nil
+		}
+	}
+
+	return "", fmt.Errorf("start_from %s does not match any buildpack", r.StartFrom)
+}
+
+func (r *BuildpackRunner) release(buildpackPath string, startCommands map[string]string) (BuildpackRelease, error) {
+	release, err := r.runRelease(buildpackPath)
+	if err != nil {
+		return BuildpackRelease{}, err
+	}
+
+	release.DefaultProcessTypes = MergeProcessTypes(release.DefaultProcessTypes, startCommands)
+
+	return release, nil
+}
+
+func (r *BuildpackRunner) runRelease(buildpackPath string) (BuildpackRelease, error) {
+	output := new(bytes.Buffer)
+
+	cmd := exec.Command(filepath.Join(buildpackPath, "bin", "release"), r.config.BuildDir())
+	cmd.Stdout = output
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return BuildpackRelease{}, err
+	}
+
+	release := BuildpackRelease{}
+	if err := yaml.Unmarshal(output.Bytes(), &release); err != nil {
+		return BuildpackRelease{}, fmt.Errorf("buildpack's release output invalid: %s", err.Error())
+	}
+
+	return release, nil
+}
+
+// mergeConfigVars returns the config_vars of every buildpack's release, in
+// buildpack order, overridden by those of the release at releasePath
+func (r *BuildpackRunner) mergeConfigVars(buildpackPaths []string, releasePath string, releaseConfigVars map[string]string) map[string]string {
+	configVars := map[string]string{}
+
+	buildpacks := r.config.BuildpackOrder()
+	for i, buildpackPath := range buildpackPaths {
+		if buildpackPath == releasePath || r.skipped[i] {
+			continue
+		}
+		if exists, err := libbuildpack.FileExists(filepath.Join(buildpackPath, "bin", "release")); err != nil || !exists {
+			continue
+		}
+
+		release, err := r.runRelease(buildpackPath)
+		if err != nil {
+			r.log.Warning("Unable to read the config_vars of %s: %s", buildpacks[i], err.Error())
+			continue
+		}
+		for name, value := range release.ConfigVars {
+			configVars[name] = value
+		}
+	}
+
+	for name, value := range releaseConfigVars {
+		configVars[name] = value
+	}
+
+	if len(configVars) == 0 {
+		return nil
+	}
+	return configVars
+}
+
+func (r *BuildpackRunner) saveInfo(infoFilePath string, release BuildpackRelease) error {
+	detectedBuildpack := ""
+
+	finalIdx := r.config.DepsIndex(len(r.config.SupplyBuildpacks()))
+	configYml := struct {
+		Name string `yaml:"name"`
+	}{}
+	if err := libbuildpack.NewYAML().Load(filepath.Join(r.depsDir, finalIdx, "config.yml"), &configYml); err == nil {
+		detectedBuildpack = configYml.Name
+	}
+
+	// JSON ⊂ YAML
+	data, err := json.Marshal(StagingInfo{
+		DetectedBuildpack: detectedBuildpack,
+		StartCommand:      release.DefaultProcessTypes["web"],
+		ProcessTypes:      release.DefaultProcessTypes,
+		Addons:            release.Addons,
+		ConfigVars:        release.ConfigVars,
+	})
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(infoFilePath, data, 0644)
+}
+
+func (r *BuildpackRunner) run(cmd *exec.Cmd) error {
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+func hasBinDirectory(path string) bool {
+	_, err := os.Stat(filepath.Join(path, "bin"))
+	return err == nil
+}
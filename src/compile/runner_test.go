@@ -0,0 +1,419 @@
+package main_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	c "compile"
+
+	"code.cloudfoundry.org/buildpackapplifecycle"
+	"github.com/cloudfoundry/libbuildpack"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("BuildpackRunner", func() {
+	var (
+		err             error
+		buildDir        string
+		cacheDir        string
+		downloadsDir    string
+		buildpacks      []string
+		config          buildpackapplifecycle.LifecycleBuilderConfig
+		runner          *c.BuildpackRunner
+		buffer          *bytes.Buffer
+		startFrom       string
+		processes       map[string]string
+		finalRelease    string
+		supplyRelease   string
+		mergeConfigVars bool
+		optional        []int
+		decorators      []string
+	)
+
+	BeforeEach(func() {
+		buildDir, err = ioutil.TempDir("", "build")
+		Expect(err).To(BeNil())
+
+		cacheDir, err = ioutil.TempDir("", "cache")
+		Expect(err).To(BeNil())
+
+		downloadsDir, err = ioutil.TempDir("", "downloads")
+		Expect(err).To(BeNil())
+
+		buffer = new(bytes.Buffer)
+		buildpacks = []string{"supply_buildpack", "final_buildpack"}
+		startFrom = ""
+		processes = nil
+		mergeConfigVars = false
+		optional = nil
+		decorators = nil
+		supplyRelease = `echo "default_process_types:"; echo "  web: ./supply-start"`
+		finalRelease = `echo "default_process_types:"; echo "  web: ./start"; echo "  worker: ./work"`
+	})
+
+	JustBeforeEach(func() {
+		compiler := &c.MultiCompiler{
+			BuildDir:     buildDir,
+			CacheDir:     cacheDir,
+			Buildpacks:   buildpacks,
+			DownloadsDir: downloadsDir,
+		}
+		config, err = compiler.NewLifecycleBuilderConfig()
+		Expect(err).To(BeNil())
+
+		writeBuildpack(config.BuildpackPath("supply_buildpack"), "supply_buildpack", map[string]string{
+			"supply":  `echo "supplied $4" > "$3/$4/supplied.txt"; touch "$2/cached"`,
+			"release": supplyRelease,
+		})
+		writeBuildpack(config.BuildpackPath("final_buildpack"), "final_buildpack", map[string]string{
+			"supply":   `echo "final supplied $4" > "$3/$4/supplied.txt"`,
+			"finalize": `if [ -f "$3/0/supplied.txt" ]; then cat "$3/0/supplied.txt" > "$1/finalized.txt"; fi; echo "name: final" > "$3/$4/config.yml"; echo "export FINAL=1" > "$5/final.sh"`,
+			"release":  finalRelease,
+		})
+
+		writeBuildpack(config.BuildpackPath("failing_buildpack"), "failing_buildpack", map[string]string{
+			"supply": `echo "partial" > "$3/$4/partial.txt"; exit 1`,
+		})
+		writeBuildpack(config.BuildpackPath("apm_decorator"), "apm_decorator", map[string]string{
+			"decorate": `cat "$1/finalized.txt" > "$1/decorated.txt"; ls "$2" > "$1/decorated_deps.txt"; echo "export APM=1" > "$3/apm.sh"`,
+			"release":  `echo "command_prefix: apm-run"`,
+		})
+		writeBuildpack(config.BuildpackPath("cnb_buildpack"), "cnb_buildpack", map[string]string{
+			"build": `mkdir -p "$1/tool/bin" "$1/tool/env"; printf "launch = true\nbuild = true\n" > "$1/tool.toml"; pwd > "$1/tool/bin/tool"; printf "$1/tool" > "$1/tool/env/TOOL_HOME.override"; printf "fast" > "$1/tool/env/TOOL_MODE"`,
+		})
+		Expect(ioutil.WriteFile(filepath.Join(config.BuildpackPath("cnb_buildpack"), "buildpack.toml"), []byte(`api = "0.7"
+
+[buildpack]
+id = "org.example.tool"
+version = "0.0.1"
+
+[metadata]
+include_files = [
+  "bin/build",
+  "buildpack.toml",
+]
+
+[[stacks]]
+id = "org.cloudfoundry.stacks.cflinuxfs3"
+`), 0644)).To(Succeed())
+
+		logger := libbuildpack.NewLogger(buffer)
+		runner = c.NewBuildpackRunner(&config, c.NewBuildpackCache(cacheDir, 0, []string{}, logger), logger)
+		runner.StartFrom = startFrom
+		runner.Processes = processes
+		runner.MergeConfigVars = mergeConfigVars
+		runner.Optional = optional
+		runner.Decorators = decorators
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(buildDir)).To(Succeed())
+		Expect(os.RemoveAll(cacheDir)).To(Succeed())
+		Expect(os.RemoveAll(downloadsDir)).To(Succeed())
+	})
+
+	Describe("Run", func() {
+		var stagingInfoFile string
+
+		JustBeforeEach(func() {
+			stagingInfoFile, err = runner.Run()
+			Expect(err).To(BeNil())
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(filepath.Dir(stagingInfoFile))).To(Succeed())
+		})
+
+		It("runs supply for every buildpack and finalize for the last one", func() {
+			contentsDir := filepath.Dir(stagingInfoFile)
+
+			Expect(ioutil.ReadFile(filepath.Join(contentsDir, "deps", "0", "supplied.txt"))).To(Equal([]byte("supplied 0\n")))
+			Expect(ioutil.ReadFile(filepath.Join(contentsDir, "deps", "1", "supplied.txt"))).To(Equal([]byte("final supplied 1\n")))
+			Expect(ioutil.ReadFile(filepath.Join(buildDir, "finalized.txt"))).To(Equal([]byte("supplied 0\n")))
+			Expect(ioutil.ReadFile(filepath.Join(contentsDir, "profile.d", "final.sh"))).To(Equal([]byte("export FINAL=1\n")))
+		})
+
+		It("writes staging_info.yml from the final buildpack's release", func() {
+			Expect(ioutil.ReadFile(stagingInfoFile)).To(MatchJSON(`{"detected_buildpack":"final","start_command":"./start","process_types":{"web":"./start","worker":"./work"}}`))
+		})
+
+		It("keeps a cache dir per buildpack, named after the buildpack", func() {
+			Expect(filepath.Join(cacheDir, "supply_buildpack", "cached")).To(BeAnExistingFile())
+			Expect(filepath.Join(cacheDir, "final_buildpack")).To(BeADirectory())
+
+			Expect(filepath.Join(cacheDir, ".buildpack_keys.yml")).To(BeAnExistingFile())
+
+			dirs, err := ioutil.ReadDir(cacheDir)
+			Expect(err).To(BeNil())
+			Expect(dirs).To(HaveLen(3))
+		})
+
+		It("prints the size of each cache", func() {
+			Expect(buffer.String()).To(ContainSubstring("Build cache sizes:"))
+			Expect(buffer.String()).To(ContainSubstring("supply_buildpack: 0\n"))
+		})
+
+		It("does not copy the app or build a droplet", func() {
+			contentsDir := filepath.Dir(stagingInfoFile)
+
+			Expect(filepath.Join(contentsDir, "app")).NotTo(BeADirectory())
+			Expect(filepath.Join(contentsDir, "tmp")).NotTo(BeADirectory())
+		})
+
+		Context("there is a Procfile", func() {
+			BeforeEach(func() {
+				Expect(ioutil.WriteFile(filepath.Join(buildDir, "Procfile"), []byte("web: ./procfile-start\nclock: ./tick\n"), 0644)).To(Succeed())
+			})
+
+			It("uses the Procfile process types over the buildpack's", func() {
+				Expect(ioutil.ReadFile(stagingInfoFile)).To(MatchJSON(`{"detected_buildpack":"final","start_command":"./procfile-start","process_types":{"web":"./procfile-start","worker":"./work","clock":"./tick"}}`))
+			})
+		})
+
+		Context("start_from names a supply buildpack", func() {
+			BeforeEach(func() {
+				startFrom = "supply_buildpack"
+			})
+
+			It("uses the process types from that buildpack's release", func() {
+				Expect(ioutil.ReadFile(stagingInfoFile)).To(MatchJSON(`{"detected_buildpack":"final","start_command":"./supply-start","process_types":{"web":"./supply-start"}}`))
+				Expect(buffer.String()).To(ContainSubstring("Using the start command from supply_buildpack"))
+			})
+		})
+
+		Context("start_from is a buildpack index", func() {
+			BeforeEach(func() {
+				startFrom = "0"
+			})
+
+			It("uses the process types from that buildpack's release", func() {
+				Expect(ioutil.ReadFile(stagingInfoFile)).To(MatchJSON(`{"detected_buildpack":"final","start_command":"./supply-start","process_types":{"web":"./supply-start"}}`))
+			})
+		})
+
+		Context("processes are set", func() {
+			BeforeEach(func() {
+				processes = map[string]string{"web": "./override", "clock": "./tick"}
+				Expect(ioutil.WriteFile(filepath.Join(buildDir, "Procfile"), []byte("web: ./procfile-start\n"), 0644)).To(Succeed())
+			})
+
+			It("overrides the buildpack's and the Procfile's process types", func() {
+				Expect(ioutil.ReadFile(stagingInfoFile)).To(MatchJSON(`{"detected_buildpack":"final","start_command":"./override","process_types":{"web":"./override","worker":"./work","clock":"./tick"}}`))
+			})
+		})
+
+		Context("the release has addons and config_vars", func() {
+			BeforeEach(func() {
+				supplyRelease = `echo "config_vars:"; echo "  SUPPLY: supply"; echo "  SHARED: supply"`
+				finalRelease = `echo "addons:"; echo "  - heroku-postgresql:dev"; echo "config_vars:"; echo "  SHARED: final"; echo "default_process_types:"; echo "  web: ./start"`
+			})
+
+			It("keeps them", func() {
+				Expect(ioutil.ReadFile(stagingInfoFile)).To(MatchJSON(`{"detected_buildpack":"final","start_command":"./start","process_types":{"web":"./start"},"addons":["heroku-postgresql:dev"],"config_vars":{"SHARED":"final"}}`))
+			})
+
+			Context("merge_config_vars is set", func() {
+				BeforeEach(func() {
+					mergeConfigVars = true
+				})
+
+				It("merges the config_vars of every buildpack", func() {
+					Expect(ioutil.ReadFile(stagingInfoFile)).To(MatchJSON(`{"detected_buildpack":"final","start_command":"./start","process_types":{"web":"./start"},"addons":["heroku-postgresql:dev"],"config_vars":{"SHARED":"final","SUPPLY":"supply"}}`))
+				})
+			})
+		})
+
+		Context("a supply buildpack is a Cloud Native Buildpack", func() {
+			BeforeEach(func() {
+				buildpacks = []string{"cnb_buildpack", "final_buildpack"}
+			})
+
+			It("runs its build in the app dir, with its layers in its deps dir", func() {
+				depsDir := filepath.Join(filepath.Dir(stagingInfoFile), "deps")
+
+				Expect(os.Readlink(filepath.Join(depsDir, "0", "bin", "tool"))).To(Equal(filepath.Join("..", "layers", "tool", "bin", "tool")))
+				Expect(ioutil.ReadFile(filepath.Join(depsDir, "0", "bin", "tool"))).To(Equal([]byte(buildDir + "\n")))
+				Expect(ioutil.ReadFile(filepath.Join(depsDir, "0", "env", "TOOL_HOME"))).To(Equal([]byte(filepath.Join(depsDir, "0", "layers", "tool"))))
+				Expect(ioutil.ReadFile(filepath.Join(depsDir, "0", "config.yml"))).To(Equal([]byte("name: org.example.tool\nversion: 0.0.1\n")))
+			})
+
+			Context("it sets a variable with an env file without a suffix", func() {
+				BeforeEach(func() {
+					os.Setenv("TOOL_MODE", "slow")
+				})
+
+				AfterEach(func() {
+					os.Unsetenv("TOOL_MODE")
+				})
+
+				It("overrides it, as its buildpack API is 0.5 or later", func() {
+					depsDir := filepath.Join(filepath.Dir(stagingInfoFile), "deps")
+
+					Expect(ioutil.ReadFile(filepath.Join(depsDir, "0", "env", "TOOL_MODE"))).To(Equal([]byte("fast")))
+				})
+			})
+		})
+
+		Context("there is a decorator", func() {
+			BeforeEach(func() {
+				decorators = []string{"apm_decorator"}
+			})
+
+			It("runs it after the final buildpack with the build, deps and profile.d dirs", func() {
+				contentsDir := filepath.Dir(stagingInfoFile)
+
+				Expect(ioutil.ReadFile(filepath.Join(buildDir, "decorated.txt"))).To(Equal([]byte("supplied 0\n")))
+				Expect(ioutil.ReadFile(filepath.Join(buildDir, "decorated_deps.txt"))).To(Equal([]byte("0\n1\n")))
+				Expect(ioutil.ReadFile(filepath.Join(contentsDir, "profile.d", "apm.sh"))).To(Equal([]byte("export APM=1\n")))
+			})
+
+			It("wraps the start commands with the prefix from its release", func() {
+				Expect(ioutil.ReadFile(stagingInfoFile)).To(MatchJSON(`{"detected_buildpack":"final","start_command":"apm-run ./start","process_types":{"web":"apm-run ./start","worker":"apm-run ./work"}}`))
+			})
+		})
+
+		Context("an optional supply buildpack fails", func() {
+			BeforeEach(func() {
+				buildpacks = []string{"failing_buildpack", "missing_buildpack", "supply_buildpack", "final_buildpack"}
+				optional = []int{0, 1}
+			})
+
+			It("skips it with a warning, leaving its deps dir empty", func() {
+				depsDir := filepath.Join(filepath.Dir(stagingInfoFile), "deps")
+
+				Expect(ioutil.ReadDir(filepath.Join(depsDir, "0"))).To(BeEmpty())
+				Expect(ioutil.ReadDir(filepath.Join(depsDir, "1"))).To(BeEmpty())
+				Expect(ioutil.ReadFile(filepath.Join(depsDir, "2", "supplied.txt"))).To(Equal([]byte("supplied 2\n")))
+				Expect(buffer.String()).To(ContainSubstring("Skipping optional buildpack failing_buildpack: " + buildpackapplifecycle.SupplyFailMsg))
+				Expect(buffer.String()).To(ContainSubstring("Skipping optional buildpack missing_buildpack: "))
+			})
+
+			It("runs the other buildpacks", func() {
+				Expect(ioutil.ReadFile(stagingInfoFile)).To(MatchJSON(`{"detected_buildpack":"final","start_command":"./start","process_types":{"web":"./start","worker":"./work"}}`))
+			})
+		})
+
+		Context("there are stale cache dirs", func() {
+			BeforeEach(func() {
+				Expect(os.MkdirAll(filepath.Join(cacheDir, "stale"), 0755)).To(Succeed())
+			})
+
+			It("removes them", func() {
+				Expect(filepath.Join(cacheDir, "stale")).NotTo(BeADirectory())
+			})
+		})
+	})
+
+	Describe("Supply and Finalize", func() {
+		var (
+			depsDir    string
+			profileDir string
+		)
+
+		BeforeEach(func() {
+			depsDir, err = ioutil.TempDir("", "deps")
+			Expect(err).To(BeNil())
+			profileDir = filepath.Join(buildDir, ".profile.d")
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(depsDir)).To(Succeed())
+		})
+
+		It("runs supply for every buildpack in the given deps dir", func() {
+			Expect(runner.Supply(filepath.Join(depsDir, "2"))).To(Succeed())
+
+			Expect(ioutil.ReadFile(filepath.Join(depsDir, "2", "0", "supplied.txt"))).To(Equal([]byte("supplied 0\n")))
+			Expect(ioutil.ReadFile(filepath.Join(depsDir, "2", "1", "supplied.txt"))).To(Equal([]byte("final supplied 1\n")))
+			Expect(filepath.Join(buildDir, "finalized.txt")).NotTo(BeAnExistingFile())
+		})
+
+		It("runs finalize for the last buildpack without supplying it again", func() {
+			Expect(runner.Supply(filepath.Join(depsDir, "2"))).To(Succeed())
+			Expect(os.Remove(filepath.Join(depsDir, "2", "1", "supplied.txt"))).To(Succeed())
+
+			stagingInfoFile, err := runner.Finalize(filepath.Join(depsDir, "2"), profileDir)
+			Expect(err).To(BeNil())
+			defer os.RemoveAll(filepath.Dir(stagingInfoFile))
+
+			Expect(filepath.Join(depsDir, "2", "1", "supplied.txt")).NotTo(BeAnExistingFile())
+			Expect(ioutil.ReadFile(filepath.Join(buildDir, "finalized.txt"))).To(Equal([]byte("supplied 0\n")))
+			Expect(ioutil.ReadFile(filepath.Join(profileDir, "final.sh"))).To(Equal([]byte("export FINAL=1\n")))
+			Expect(ioutil.ReadFile(stagingInfoFile)).To(MatchJSON(`{"detected_buildpack":"final","start_command":"./start","process_types":{"web":"./start","worker":"./work"}}`))
+		})
+	})
+
+	Context("the buildpacks fail to run", func() {
+		var existingContentsDirs []string
+
+		BeforeEach(func() {
+			existingContentsDirs, err = filepath.Glob(filepath.Join(os.TempDir(), "contents*"))
+			Expect(err).To(BeNil())
+		})
+
+		AfterEach(func() {
+			contentsDirs, err := filepath.Glob(filepath.Join(os.TempDir(), "contents*"))
+			Expect(err).To(BeNil())
+			for _, dir := range contentsDirs {
+				if !containsString(existingContentsDirs, dir) {
+					Expect(os.RemoveAll(dir)).To(Succeed())
+				}
+			}
+		})
+
+		Context("a supply buildpack has no bin/supply", func() {
+			BeforeEach(func() {
+				buildpacks = []string{"compile_only_buildpack", "final_buildpack"}
+			})
+
+			It("returns an error without running any buildpacks", func() {
+				writeBuildpack(config.BuildpackPath("compile_only_buildpack"), "compile_only_buildpack", map[string]string{"compile": "exit 0"})
+
+				stagingInfoFile, err := runner.Run()
+				Expect(err).NotTo(BeNil())
+				Expect(err.Error()).To(ContainSubstring(buildpackapplifecycle.NoSupplyScriptFailMsg))
+				Expect(stagingInfoFile).To(Equal(""))
+				Expect(filepath.Join(buildDir, "finalized.txt")).NotTo(BeAnExistingFile())
+			})
+		})
+
+		Context("a required supply buildpack fails", func() {
+			BeforeEach(func() {
+				buildpacks = []string{"failing_buildpack", "final_buildpack"}
+			})
+
+			It("returns an error", func() {
+				stagingInfoFile, err := runner.Run()
+				Expect(err).NotTo(BeNil())
+				Expect(err.Error()).To(ContainSubstring(buildpackapplifecycle.SupplyFailMsg))
+				Expect(stagingInfoFile).To(Equal(""))
+				Expect(buffer.String()).NotTo(ContainSubstring("Skipping"))
+			})
+		})
+
+		Context("start_from does not match a buildpack", func() {
+			BeforeEach(func() {
+				startFrom = "php"
+			})
+
+			It("returns an error", func() {
+				stagingInfoFile, err := runner.Run()
+				Expect(err).NotTo(BeNil())
+				Expect(err.Error()).To(ContainSubstring("start_from php does not match any buildpack"))
+				Expect(stagingInfoFile).To(Equal(""))
+			})
+		})
+	})
+})
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -1,25 +1,67 @@
 package main
 
 import (
-	"code.cloudfoundry.org/buildpackapplifecycle/buildpackrunner"
+	"os"
+	"path/filepath"
+
 	"github.com/cloudfoundry/libbuildpack"
 )
 
-func WriteStartCommand(stagingInfoFile string, outputFile string) error {
-	var stagingInfo buildpackrunner.DeaStagingInfo
+// StagingInfo is the staging_info.yml the BuildpackRunner writes; it is a
+// DeaStagingInfo that also keeps every process type, not just web
+type StagingInfo struct {
+	DetectedBuildpack string            `json:"detected_buildpack" yaml:"detected_buildpack"`
+	StartCommand      string            `json:"start_command" yaml:"start_command"`
+	ProcessTypes      map[string]string `json:"process_types,omitempty" yaml:"process_types,omitempty"`
+	Addons            []string          `json:"addons,omitempty" yaml:"addons,omitempty"`
+	ConfigVars        map[string]string `json:"config_vars,omitempty" yaml:"config_vars,omitempty"`
+}
+
+// MergeProcessTypes returns the buildpack's process types overridden by the
+// ones in the app's Procfile
+func MergeProcessTypes(buildpackProcessTypes, procfileProcessTypes map[string]string) map[string]string {
+	processTypes := map[string]string{}
+	for name, command := range buildpackProcessTypes {
+		processTypes[name] = command
+	}
+	for name, command := range procfileProcessTypes {
+		processTypes[name] = command
+	}
+	return processTypes
+}
+
+// WriteStartCommand writes the release from staging_info.yml to the
+// ReleaseFile in buildDir
+func WriteStartCommand(stagingInfoFile string, buildDir string) error {
+	var stagingInfo StagingInfo
 
 	err := libbuildpack.NewYAML().Load(stagingInfoFile, &stagingInfo)
 	if err != nil {
 		return err
 	}
 
-	var webStartCommand = map[string]string{
-		"web": stagingInfo.StartCommand,
+	processTypes := MergeProcessTypes(stagingInfo.ProcessTypes, nil)
+	if stagingInfo.StartCommand != "" || len(processTypes) == 0 {
+		processTypes["web"] = stagingInfo.StartCommand
 	}
 
-	release := buildpackrunner.Release{
-		DefaultProcessTypes: webStartCommand,
+	absBuildDir, err := filepath.Abs(buildDir)
+	if err != nil {
+		return err
+	}
+
+	release := MultiBuildpackRelease{
+		BuildDir: absBuildDir,
+		BuildpackRelease: BuildpackRelease{
+			Addons:              stagingInfo.Addons,
+			ConfigVars:          stagingInfo.ConfigVars,
+			DefaultProcessTypes: processTypes,
+		},
+	}
+
+	if err := os.MkdirAll(filepath.Join(buildDir, filepath.Dir(ReleaseFile)), 0755); err != nil {
+		return err
 	}
 
-	return libbuildpack.NewYAML().Write(outputFile, &release)
+	return libbuildpack.NewYAML().Write(filepath.Join(buildDir, ReleaseFile), &release)
 }
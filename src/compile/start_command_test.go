@@ -15,7 +15,7 @@ var _ = Describe("WriteStartCommand", func() {
 	var (
 		stagingInfoDir  string
 		stagingInfoFile string
-		outputDir       string
+		buildDir        string
 		outputFile      string
 		err             error
 	)
@@ -25,16 +25,16 @@ var _ = Describe("WriteStartCommand", func() {
 		Expect(err).To(BeNil())
 		stagingInfoFile = filepath.Join(stagingInfoDir, "staging_info.yml")
 
-		outputDir, err = ioutil.TempDir("", "release")
+		buildDir, err = ioutil.TempDir("", "build")
 		Expect(err).To(BeNil())
-		outputFile = filepath.Join(outputDir, "multi-buildpack-release.yml")
+		outputFile = filepath.Join(buildDir, ".multi-buildpack", "release.yml")
 	})
 
 	AfterEach(func() {
 		err = os.RemoveAll(stagingInfoDir)
 		Expect(err).To(BeNil())
 
-		err = os.RemoveAll(outputDir)
+		err = os.RemoveAll(buildDir)
 		Expect(err).To(BeNil())
 	})
 
@@ -45,14 +45,48 @@ var _ = Describe("WriteStartCommand", func() {
 			Expect(err).To(BeNil())
 		})
 
-		It("writes the intended release output to multi-buildpack-release.yml ", func() {
-			err = c.WriteStartCommand(stagingInfoFile, outputFile)
+		It("writes the intended release output to .multi-buildpack/release.yml", func() {
+			err = c.WriteStartCommand(stagingInfoFile, buildDir)
 
 			Expect(err).To(BeNil())
 
 			data, err := ioutil.ReadFile(outputFile)
 			Expect(err).To(BeNil())
-			Expect(string(data)).To(Equal("default_process_types:\n  web: run_thing arg1 arg2\n"))
+			Expect(string(data)).To(Equal("build_dir: " + buildDir + "\ndefault_process_types:\n  web: run_thing arg1 arg2\n"))
+		})
+	})
+
+	Context("staging_info.yml has process types", func() {
+		BeforeEach(func() {
+			content := `{"detected_buildpack":"some_buildpack","start_command":"run_thing","process_types":{"web":"run_thing","worker":"run_worker","clock":"run_clock"}}`
+			err = ioutil.WriteFile(stagingInfoFile, []byte(content), 0644)
+			Expect(err).To(BeNil())
+		})
+
+		It("writes all of them to .multi-buildpack/release.yml", func() {
+			err = c.WriteStartCommand(stagingInfoFile, buildDir)
+			Expect(err).To(BeNil())
+
+			data, err := ioutil.ReadFile(outputFile)
+			Expect(err).To(BeNil())
+			Expect(string(data)).To(Equal("build_dir: " + buildDir + "\ndefault_process_types:\n  clock: run_clock\n  web: run_thing\n  worker: run_worker\n"))
+		})
+	})
+
+	Context("staging_info.yml has addons and config_vars", func() {
+		BeforeEach(func() {
+			content := `{"detected_buildpack":"some_buildpack","start_command":"run_thing","addons":["heroku-postgresql:dev"],"config_vars":{"RACK_ENV":"production"}}`
+			err = ioutil.WriteFile(stagingInfoFile, []byte(content), 0644)
+			Expect(err).To(BeNil())
+		})
+
+		It("carries them to .multi-buildpack/release.yml", func() {
+			err = c.WriteStartCommand(stagingInfoFile, buildDir)
+			Expect(err).To(BeNil())
+
+			data, err := ioutil.ReadFile(outputFile)
+			Expect(err).To(BeNil())
+			Expect(string(data)).To(Equal("build_dir: " + buildDir + "\naddons:\n- heroku-postgresql:dev\nconfig_vars:\n  RACK_ENV: production\ndefault_process_types:\n  web: run_thing\n"))
 		})
 	})
 
@@ -64,15 +98,24 @@ var _ = Describe("WriteStartCommand", func() {
 		})
 
 		It("returns an error", func() {
-			err = c.WriteStartCommand(stagingInfoFile, outputFile)
+			err = c.WriteStartCommand(stagingInfoFile, buildDir)
 
 			Expect(err).NotTo(BeNil())
 		})
 	})
 
+	Describe("MergeProcessTypes", func() {
+		It("overrides the buildpack's process types with the Procfile's", func() {
+			Expect(c.MergeProcessTypes(
+				map[string]string{"web": "bundle exec rails s", "worker": "bundle exec sidekiq"},
+				map[string]string{"web": "bin/start", "clock": "bin/clock"},
+			)).To(Equal(map[string]string{"web": "bin/start", "worker": "bundle exec sidekiq", "clock": "bin/clock"}))
+		})
+	})
+
 	Context("staging_info.yml does not exist", func() {
 		It("returns an error", func() {
-			err = c.WriteStartCommand(stagingInfoFile, outputFile)
+			err = c.WriteStartCommand(stagingInfoFile, buildDir)
 
 			Expect(err).NotTo(BeNil())
 		})